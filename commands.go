@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"mrnakumar.com/poli/constants"
+	"mrnakumar.com/poli/fetch"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// command
+// is a subcommand of poli, such as 'users add'.
+type command struct {
+	name string
+	// args describes the arguments after the flags, empty if the command takes none
+	args    string
+	summary string
+	// twitter is whether the command calls twitter and so needs the bearer token
+	twitter bool
+	// handlesSignals is whether run stops on SIGINT and SIGTERM itself, instead of through the cancelled context
+	handlesSignals bool
+	flags          func(fs *flag.FlagSet, flags *Flags)
+	validate       func(flags Flags) error
+	run            func(ctx context.Context, flags Flags) error
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{
+			name:     "users add",
+			args:     "<userName>...",
+			summary:  "Starts downloading the tweets of the users",
+			twitter:  true,
+			validate: requireArgs,
+			run:      addUsers,
+		},
+		{
+			name:    "users list",
+			summary: "Prints the users whose tweets are downloaded",
+			run:     listUsers,
+		},
+		{
+			name:     "users import",
+			args:     "<file>...",
+			summary:  "Starts downloading the tweets of the users named in CSV or text files, looking them up in batches",
+			twitter:  true,
+			validate: requireFiles,
+			run:      importUsers,
+		},
+		{
+			name:     "users remove",
+			args:     "<userName>...",
+			summary:  "Stops downloading the tweets of the users and removes those downloaded",
+			validate: requireArgs,
+			run:      removeUsers,
+		},
+		{
+			name:    "users refresh",
+			summary: "Updates the names and profiles of the users from twitter, keeping the history of their changes",
+			twitter: true,
+			flags: func(fs *flag.FlagSet, flags *Flags) {
+				fs.StringVar(&flags.userName, FlagUserName, "", "<Optional> The user to refresh. All the users by default")
+			},
+			run: refreshUsers,
+		},
+		{
+			name:    "users history",
+			summary: "Prints the changes to the profile of a user found by 'users refresh'",
+			flags: func(fs *flag.FlagSet, flags *Flags) {
+				fs.StringVar(&flags.userName, FlagUserName, "", "<Mandatory> The user whose profile history this is")
+			},
+			validate: requireUser,
+			run:      showProfileHistory,
+		},
+		{
+			name:     "lists sync",
+			args:     "<listId>...",
+			summary:  "Starts downloading the tweets of the members of twitter lists and flags the users who left them",
+			twitter:  true,
+			validate: requireListIds,
+			run:      syncLists,
+		},
+		{
+			name:    "fetch",
+			summary: "Downloads the new tweets of the users",
+			twitter: true,
+			flags: func(fs *flag.FlagSet, flags *Flags) {
+				fs.StringVar(&flags.userName, FlagUserName, "", "<Optional> The user to download tweets for. All the users by default")
+				addRunFlags(fs, flags)
+			},
+			validate: validateRunFlags,
+			run:      fetchTweets,
+		},
+		{
+			name:           "serve",
+			summary:        "Downloads the new tweets of all the users every interval until stopped",
+			twitter:        true,
+			handlesSignals: true,
+			flags: func(fs *flag.FlagSet, flags *Flags) {
+				fs.DurationVar(&flags.interval, FlagInterval, 15*time.Minute, "<Optional> How often to download tweets for all users")
+				fs.Func(FlagLists, "<Optional> Comma separated ids of twitter lists whose members are synced before each download, as by 'lists sync'", func(value string) error {
+					flags.lists = nil
+					for _, listId := range strings.Split(value, ",") {
+						flags.lists = append(flags.lists, strings.TrimSpace(listId))
+					}
+					return requireListIds(Flags{args: flags.lists})
+				})
+				addRunFlags(fs, flags)
+			},
+			validate: func(flags Flags) error {
+				if flags.interval <= 0 {
+					return fmt.Errorf("'%s' must be positive", FlagInterval)
+				}
+				return validateRunFlags(flags)
+			},
+			run: serve,
+		},
+		{
+			name:    "backfill",
+			summary: "Downloads the tweets of the users older than those downloaded",
+			twitter: true,
+			flags: func(fs *flag.FlagSet, flags *Flags) {
+				fs.StringVar(&flags.userName, FlagUserName, "", "<Optional> The user to backfill tweets for. All the users by default")
+				fs.Func(FlagBackfillSince, "<Optional> The date (2006-01-02) or time (2006-01-02T15:04:05Z) to backfill tweets back to. Goes back as far as twitter allows by default", func(value string) (err error) {
+					flags.backfillSince, err = parseTime(value)
+					return err
+				})
+				addRunFlags(fs, flags)
+			},
+			validate: validateRunFlags,
+			run:      backfill,
+		},
+		{
+			name:     "checkpoint show",
+			summary:  "Prints the checkpoints the tweets of a user are downloaded from",
+			flags:    addCheckpointUserFlag,
+			validate: requireUser,
+			run:      showCheckpoints,
+		},
+		{
+			name:    "checkpoint reset",
+			summary: "Clears the checkpoints of a user so that their tweets are downloaded again",
+			flags: func(fs *flag.FlagSet, flags *Flags) {
+				addCheckpointUserFlag(fs, flags)
+				fs.Func(FlagKind, fmt.Sprintf("<Optional> Comma separated checkpoints to clear, of ['%s']. All of them by default", joinKinds(fetch.WaterMarkKinds)), func(value string) error {
+					// a later source of the setting replaces the kinds of an earlier one
+					flags.kinds = nil
+					for _, kind := range strings.Split(value, ",") {
+						if !fetch.IsWaterMarkKind(fetch.WaterMarkType(kind)) {
+							return fmt.Errorf("must be of ['%s']", joinKinds(fetch.WaterMarkKinds))
+						}
+						flags.kinds = append(flags.kinds, fetch.WaterMarkType(kind))
+					}
+					return nil
+				})
+			},
+			validate: requireUser,
+			run:      resetCheckpoints,
+		},
+		{
+			name:    "migrate",
+			summary: "Migrates the database schema",
+			flags: func(fs *flag.FlagSet, flags *Flags) {
+				fs.IntVar(&flags.schemaVersion, FlagSchemaVersion, fetch.LatestSchemaVersion, "<Optional> The schema version to migrate the database to. Migrates to the latest version by default, 0 drops all the tables")
+			},
+			run: migrate,
+		},
+	}
+}
+
+// findCommand returns the command named by the first arguments and the arguments after its name
+func findCommand(arguments []string) (*command, []string) {
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(arguments) < len(words) {
+			continue
+		}
+		matches := true
+		for i, word := range words {
+			if arguments[i] != word {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return cmd, arguments[len(words):]
+		}
+	}
+	return nil, nil
+}
+
+func requireArgs(flags Flags) error {
+	if len(flags.args) == 0 {
+		return fmt.Errorf("at least one user name is required")
+	}
+	return nil
+}
+
+func requireFiles(flags Flags) error {
+	if len(flags.args) == 0 {
+		return fmt.Errorf("at least one file is required")
+	}
+	return nil
+}
+
+func requireListIds(flags Flags) error {
+	if len(flags.args) == 0 {
+		return fmt.Errorf("at least one list id is required")
+	}
+	for _, listId := range flags.args {
+		if _, err := strconv.ParseUint(listId, 10, 64); err != nil {
+			return fmt.Errorf("list id '%s' must be a number", listId)
+		}
+	}
+	return nil
+}
+
+func requireUser(flags Flags) error {
+	if flags.userName == "" {
+		return fmt.Errorf("'%s' is required", FlagUserName)
+	}
+	return nil
+}
+
+func addCheckpointUserFlag(fs *flag.FlagSet, flags *Flags) {
+	fs.StringVar(&flags.userName, FlagUserName, "", "<Mandatory> The user whose checkpoints these are")
+}
+
+// withFetcher calls fn with a Fetcher on the datastore of flags, closing the datastore after
+func withFetcher(flags Flags, fn func(fetcher *fetch.Fetcher) error) error {
+	store := openStore(flags)
+	defer closeDb(store)
+	fetcher, closeFetcher := newFetcher(flags, store)
+	defer closeFetcher()
+	return fn(fetcher)
+}
+
+// forEachArg
+// calls fn with each of the user names in the arguments, going on after a failure unless it would repeat for the
+// others.
+func forEachArg(flags Flags, fn func(userName string) error) error {
+	failures := make(fetch.UserErrors)
+	for _, userName := range flags.args {
+		err := fn(userName)
+		if err != nil {
+			log.Error().Str(constants.LoggerId, loggerId).Err(err).Msgf("failed for user '%s'", userName)
+			failures[userName] = err
+			if errors.Is(err, fetch.ErrUnauthorized) || errors.Is(err, fetch.ErrRateLimited) {
+				break
+			}
+		}
+	}
+	if len(failures) > 0 {
+		return failures
+	}
+	return nil
+}
+
+func addUsers(ctx context.Context, flags Flags) error {
+	return withFetcher(flags, func(fetcher *fetch.Fetcher) error {
+		return forEachArg(flags, func(userName string) error {
+			return fetcher.AddUser(ctx, userName)
+		})
+	})
+}
+
+func importUsers(ctx context.Context, flags Flags) error {
+	var userNames []string
+	for _, path := range flags.args {
+		names, err := readUserNames(path)
+		if err != nil {
+			return err
+		}
+		userNames = append(userNames, names...)
+	}
+	return withFetcher(flags, func(fetcher *fetch.Fetcher) error {
+		result, err := fetcher.ImportUsers(ctx, userNames)
+		if result != nil {
+			if printErr := printUserOutcomes([]userOutcome{
+				{"added", result.Added},
+				{"already tracked", result.AlreadyTracked},
+				{"not found", result.NotFound},
+				{"suspended", result.Suspended},
+				{"invalid", result.Invalid},
+			}); printErr != nil && err == nil {
+				err = printErr
+			}
+		}
+		return err
+	})
+}
+
+func showProfileHistory(ctx context.Context, flags Flags) error {
+	return withFetcher(flags, func(fetcher *fetch.Fetcher) error {
+		changes, err := fetcher.GetProfileHistory(ctx, flags.userName)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "CHANGED AT\tFIELD\tOLD\tNEW")
+		for _, change := range changes {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", change.ChangedAt.Format(time.RFC3339), change.Field, change.OldValue, change.NewValue)
+		}
+		return w.Flush()
+	})
+}
+
+func syncLists(ctx context.Context, flags Flags) error {
+	return withFetcher(flags, func(fetcher *fetch.Fetcher) error {
+		for _, listId := range flags.args {
+			result, err := fetcher.SyncList(ctx, listId)
+			if err != nil {
+				return fmt.Errorf("failed to sync list '%s': %w", listId, err)
+			}
+			fmt.Printf("list %s\n", listId)
+			err = printUserOutcomes([]userOutcome{
+				{"added", result.Added},
+				{"joined", result.Joined},
+				{"left", result.Left},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// userOutcome names the users that something happened to
+type userOutcome struct {
+	name      string
+	userNames []string
+}
+
+func printUserOutcomes(outcomes []userOutcome) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RESULT\tCOUNT\tUSERS")
+	for _, outcome := range outcomes {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", outcome.name, len(outcome.userNames), strings.Join(outcome.userNames, ", "))
+	}
+	return w.Flush()
+}
+
+// readUserNames
+// reads the user names in the file at path. A CSV file, named '.csv', has them in its 'username' column if its header
+// has one, otherwise in its first column. Any other file has one name on each line, ignoring blank lines and those
+// starting with '#'.
+func readUserNames(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var userNames []string
+	if !strings.EqualFold(filepath.Ext(path), ".csv") {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if len(line) > 0 && !strings.HasPrefix(line, "#") {
+				userNames = append(userNames, line)
+			}
+		}
+		return userNames, scanner.Err()
+	}
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read '%s': %w", path, err)
+	}
+	column := 0
+	if len(records) > 0 {
+		for i, heading := range records[0] {
+			if strings.EqualFold(strings.TrimSpace(heading), "username") {
+				column = i
+				records = records[1:]
+				break
+			}
+		}
+	}
+	for _, record := range records {
+		if column < len(record) && len(strings.TrimSpace(record[column])) > 0 {
+			userNames = append(userNames, strings.TrimSpace(record[column]))
+		}
+	}
+	return userNames, nil
+}
+
+func listUsers(ctx context.Context, flags Flags) error {
+	store := openStore(flags)
+	defer closeDb(store)
+	users, err := store.GetAllUsers(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tPROFILE PICTURE")
+	for _, user := range users {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", user.Id, user.Name, user.ProfilePictureUrl)
+	}
+	return w.Flush()
+}
+
+func removeUsers(ctx context.Context, flags Flags) error {
+	return withFetcher(flags, func(fetcher *fetch.Fetcher) error {
+		return forEachArg(flags, func(userName string) error {
+			return fetcher.RemoveUser(ctx, userName)
+		})
+	})
+}
+
+func refreshUsers(ctx context.Context, flags Flags) error {
+	return withFetcher(flags, func(fetcher *fetch.Fetcher) error {
+		return fetcher.RefreshUsers(ctx, flags.userName)
+	})
+}
+
+func fetchTweets(ctx context.Context, flags Flags) error {
+	return withFetcher(flags, func(fetcher *fetch.Fetcher) error {
+		if flags.userName == "" {
+			return fetcher.GetAllUserTweets(ctx)
+		}
+		return fetcher.GetUserTweets(ctx, flags.userName)
+	})
+}
+
+// serve
+// downloads tweets every interval until SIGINT or SIGTERM. The first signal lets the users in progress complete,
+// a second one cancels them and exits.
+func serve(ctx context.Context, flags Flags) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		sig := <-signals
+		log.Info().Str(constants.LoggerId, loggerId).Msgf("received '%s', completing the users in progress. Repeat to exit now", sig)
+		close(stop)
+		sig = <-signals
+		log.Warn().Str(constants.LoggerId, loggerId).Msgf("received '%s' again, cancelling the users in progress", sig)
+		cancel()
+	}()
+	store := openStore(flags)
+	fetcher, closeFetcher := newFetcher(flags, store)
+	fetcher.Serve(ctx, flags.interval, stop)
+	closeFetcher()
+	closeDb(store)
+	if ctx.Err() != nil {
+		os.Exit(constants.INTERRUPTED)
+	}
+	return nil
+}
+
+func backfill(ctx context.Context, flags Flags) error {
+	return withFetcher(flags, func(fetcher *fetch.Fetcher) error {
+		if flags.userName == "" {
+			return fetcher.BackfillAllUserTweets(ctx, flags.backfillSince)
+		}
+		return fetcher.BackfillUserTweets(ctx, flags.userName, flags.backfillSince)
+	})
+}
+
+func showCheckpoints(ctx context.Context, flags Flags) error {
+	return withFetcher(flags, func(fetcher *fetch.Fetcher) error {
+		waterMarks, err := fetcher.GetWaterMarks(ctx, flags.userName)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "KIND\tCHECKPOINT")
+		for _, kind := range fetch.WaterMarkKinds {
+			if waterMark, ok := waterMarks[kind]; ok {
+				fmt.Fprintf(w, "%s\t%s\n", kind, waterMark)
+			}
+		}
+		return w.Flush()
+	})
+}
+
+func resetCheckpoints(ctx context.Context, flags Flags) error {
+	return withFetcher(flags, func(fetcher *fetch.Fetcher) error {
+		return fetcher.ResetWaterMarks(ctx, flags.userName, flags.kinds)
+	})
+}
+
+func migrate(ctx context.Context, flags Flags) error {
+	store := openStore(flags)
+	defer closeDb(store)
+	migrator, ok := store.(fetch.Migrator)
+	if !ok {
+		log.Info().Str(constants.LoggerId, loggerId).Msg("datastore has no schema to migrate")
+		return nil
+	}
+	err := migrator.Migrate(ctx, flags.schemaVersion)
+	if err != nil {
+		return err
+	}
+	version, err := migrator.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	log.Info().Str(constants.LoggerId, loggerId).Msgf("datastore is at schema version '%d'", version)
+	return nil
+}
+
+func joinKinds(kinds []fetch.WaterMarkType) string {
+	names := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		names = append(names, string(kind))
+	}
+	return strings.Join(names, "', '")
+}
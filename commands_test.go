@@ -0,0 +1,26 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReadUserNames(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		content  string
+		expected []string
+	}{
+		{"users.txt", "# legislators\npoli_user\n\n  @other_user \n", []string{"poli_user", "@other_user"}},
+		{"users.csv", "name,username\nPoli User,poli_user\nOther, other_user \nNobody,\n", []string{"poli_user", "other_user"}},
+		{"users.CSV", "poli_user,Poli User\nother_user\n", []string{"poli_user", "other_user"}},
+	} {
+		userNames, err := readUserNames(writeFile(t, test.name, test.content))
+		if err != nil {
+			t.Fatalf("Error = %v; expected nil", err)
+		}
+		if !reflect.DeepEqual(userNames, test.expected) {
+			t.Errorf("user names of %s = %v; expected = %v", test.name, userNames, test.expected)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// envPrefix starts the names of the environment variables of the flags, such as POLI_DB_PASSWORD for dbPassword
+const envPrefix = "POLI_"
+
+// secretFileSuffix names the flags reading a secret from a file, such as bearerFile for bearer
+const secretFileSuffix = "File"
+
+// addSecretFileFlag
+// adds a flag setting target to the content of a file, which is how docker and kubernetes hand out secrets.
+func addSecretFileFlag(fs *flag.FlagSet, name string, target *string) {
+	usage := fmt.Sprintf("<Optional> File to read '%s' from, such as a docker or kubernetes secret", name)
+	fs.Func(name+secretFileSuffix, usage, func(path string) error {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		*target = strings.TrimSpace(string(content))
+		return nil
+	})
+}
+
+// loadSettings
+// sets the flags of fs from the config file at path, if any, then from the environment variables. The flags given on
+// the command line are parsed after, so they override both.
+func loadSettings(fs *flag.FlagSet, path string) error {
+	if len(path) > 0 {
+		settings, err := readConfigFile(path)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(settings))
+		for name := range settings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if fs.Lookup(name) == nil {
+				if !isKnownFlag(name) {
+					return fmt.Errorf("unknown setting '%s' in '%s'", name, path)
+				}
+				// the setting of another command
+				continue
+			}
+			// do not echo the value as it can be a secret
+			if err = fs.Set(name, settings[name]); err != nil {
+				return fmt.Errorf("invalid setting '%s' in '%s': %w", name, path, err)
+			}
+		}
+	}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || f.Name == FlagConfig || err != nil {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid environment variable '%s': %w", envName(f.Name), setErr)
+		}
+	})
+	return err
+}
+
+// readConfigFile
+// reads the flat YAML map of flag names to values at path. A list is joined by commas. The values are kept as written,
+// so that a password such as 0123 is not read as a number.
+func readConfigFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]configValue
+	err = yaml.Unmarshal(content, &values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file '%s': %w", path, err)
+	}
+	settings := make(map[string]string, len(values))
+	for name, value := range values {
+		if value.invalid {
+			return nil, fmt.Errorf("setting '%s' in '%s' must be a value or a list of values", name, path)
+		}
+		settings[name] = value.text
+	}
+	return settings, nil
+}
+
+// configValue
+// is a setting of the config file, with the text of its scalars as written rather than as resolved by YAML. It is
+// invalid if it is neither a scalar nor a list of them, which is reported with the name of the setting.
+type configValue struct {
+	text    string
+	invalid bool
+}
+
+func (v *configValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var scalar string
+	if err := unmarshal(&scalar); err == nil {
+		v.text = scalar
+		return nil
+	}
+	var items []string
+	if err := unmarshal(&items); err != nil {
+		v.invalid = true
+		return nil
+	}
+	v.text = strings.Join(items, ",")
+	return nil
+}
+
+// configPath
+// returns the value of the config flag in args, which has to be known before the other flags are parsed, or else
+// of its environment variable.
+func configPath(args []string) string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == FlagConfig && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(name, FlagConfig+"=") {
+			return strings.TrimPrefix(name, FlagConfig+"=")
+		}
+	}
+	return os.Getenv(envName(FlagConfig))
+}
+
+// envName returns the environment variable of a flag, POLI_DB_PASSWORD for dbPassword
+func envName(flagName string) string {
+	var name strings.Builder
+	name.WriteString(envPrefix)
+	for i, r := range flagName {
+		if unicode.IsUpper(r) && i > 0 {
+			name.WriteRune('_')
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+	return name.String()
+}
+
+// isKnownFlag returns whether any command has the flag name
+func isKnownFlag(name string) bool {
+	for _, cmd := range commands {
+		if newFlagSet(cmd, &Flags{}).Lookup(name) != nil {
+			return true
+		}
+	}
+	return false
+}
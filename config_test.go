@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	return path
+}
+
+func setenv(t *testing.T, key string, value string) {
+	previous, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestSettingsPrecedence(t *testing.T) {
+	config := writeFile(t, "poli.yaml", "dbHost: file-host\ndbName: file-name\ndbUser: file-user\nconcurrency: 3\ninterval: 1h\n")
+	setenv(t, "POLI_DB_NAME", "env-name")
+	setenv(t, "POLI_DB_USER", "env-user")
+	args := []string{"-config", config, "-dbUser", "flag-user"}
+	var flags Flags
+	cmd, _ := findCommand([]string{"fetch"})
+	fs := newFlagSet(cmd, &flags)
+	if err := loadSettings(fs, configPath(args)); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if flags.dbHost != "file-host" || flags.dbName != "env-name" || flags.dbUser != "flag-user" {
+		t.Errorf("host, name, user = %s, %s, %s; expected = file-host, env-name, flag-user", flags.dbHost, flags.dbName, flags.dbUser)
+	}
+	if flags.concurrency != 3 {
+		t.Errorf("concurrency = %d; expected = 3", flags.concurrency)
+	}
+}
+
+func TestSecretFromFile(t *testing.T) {
+	secret := writeFile(t, "bearer", "secret-token\n")
+	setenv(t, "POLI_BEARER_FILE", secret)
+	var flags Flags
+	cmd, _ := findCommand([]string{"fetch"})
+	fs := newFlagSet(cmd, &flags)
+	if err := loadSettings(fs, ""); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if flags.bearerToken != "secret-token" {
+		t.Errorf("bearer = '%s'; expected = 'secret-token'", flags.bearerToken)
+	}
+}
+
+func TestUnknownSetting(t *testing.T) {
+	config := writeFile(t, "poli.yaml", "dbHots: localhost\n")
+	cmd, _ := findCommand([]string{"migrate"})
+	if err := loadSettings(newFlagSet(cmd, &Flags{}), config); err == nil {
+		t.Errorf("Error = nil; expected unknown setting")
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	if name := envName(FlagDbPassword); name != "POLI_DB_PASSWORD" {
+		t.Errorf("name = %s; expected = POLI_DB_PASSWORD", name)
+	}
+}
+
+func TestDbSslModeDefaultsToPostgres(t *testing.T) {
+	var flags Flags
+	cmd, _ := findCommand([]string{"fetch"})
+	if err := newFlagSet(cmd, &flags).Parse(nil); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if flags.dbSslMode != "" {
+		t.Errorf("sslmode = %q; expected empty for the default of Postgres", flags.dbSslMode)
+	}
+}
+
+func TestConfigFileKeepsValuesAsWritten(t *testing.T) {
+	config := writeFile(t, "poli.yaml", "dbPassword: 0123\nbearer: yes\nconsumerSecret: 1e3\nconsumerKey: 0x1F\n"+
+		"dbName: ~\nlists: [1234, 0567]\n")
+	settings, err := readConfigFile(config)
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	expected := map[string]string{"dbPassword": "0123", "bearer": "yes", "consumerSecret": "1e3", "consumerKey": "0x1F",
+		"dbName": "", "lists": "1234,0567"}
+	if !reflect.DeepEqual(settings, expected) {
+		t.Errorf("settings = %v; expected = %v", settings, expected)
+	}
+	if _, err = readConfigFile(writeFile(t, "nested.yaml", "dbName:\n  name: poli\n")); err == nil {
+		t.Errorf("Error = nil; expected a map to be refused")
+	}
+}
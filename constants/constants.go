@@ -5,4 +5,8 @@ const (
 
 	// exit codes
 	INVALID_FLAGS = 1
+	INTERRUPTED   = 2
+	UNAUTHORIZED  = 3
+	RATE_LIMITED  = 4
+	FAILED        = 5
 )
@@ -0,0 +1,459 @@
+// Package faketwitter
+// is a local stand-in for the v2 api of twitter, so that poli can be tested end to end without the network. It
+// serves the users, timelines and lists it is given, with pagination, since_id and the other bounds of a timeline, rate
+// limit headers and the error responses of twitter.
+package faketwitter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The endpoints served, named like the rate limited endpoints of poli
+const (
+	EndpointUserTweets  = "/2/users/:id/tweets"
+	EndpointUserByName  = "/2/users/by/username/:username"
+	EndpointUserById    = "/2/users/:id"
+	EndpointUsersByName = "/2/users/by"
+	EndpointListMembers = "/2/lists/:id/members"
+	EndpointToken       = "/oauth2/token"
+)
+
+const problemResourceNotFound = "https://api.twitter.com/2/problems/resource-not-found"
+const problemInvalidRequest = "https://api.twitter.com/2/problems/invalid-request"
+
+// nextTokenPrefix starts the pagination tokens, which are the number of tweets to skip
+const nextTokenPrefix = "next-"
+
+type User struct {
+	Id              string `json:"id"`
+	Name            string `json:"name"`
+	UserName        string `json:"username"`
+	ProfileImageUrl string `json:"profile_image_url"`
+	Description     string `json:"description"`
+	Location        string `json:"location"`
+	Url             string `json:"url"`
+	Verified        bool   `json:"verified"`
+	Protected       bool   `json:"protected"`
+	// Suspended users are answered with the errors of a suspended account
+	Suspended bool `json:"-"`
+}
+
+type Tweet struct {
+	Id        string    `json:"id"`
+	Text      string    `json:"text"`
+	Lang      string    `json:"lang,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	AuthorId  string    `json:"author_id"`
+}
+
+// Server
+// is an httptest.Server answering like twitter. It is safe for concurrent use.
+type Server struct {
+	*httptest.Server
+	// Bearer is the only token accepted if not empty, any token is accepted otherwise
+	Bearer string
+	// ConsumerKey and ConsumerSecret are exchanged for Bearer at the token endpoint
+	ConsumerKey    string
+	ConsumerSecret string
+	// RateLimit is the number of requests allowed to each endpoint in a Window, none if 0
+	RateLimit int
+	Window    time.Duration
+	mu        sync.Mutex
+	users     map[string]*User
+	// tweets are by the id of their author, newest first
+	tweets map[string][]Tweet
+	// lists are the ids of their members by the id of the list
+	lists    map[string][]string
+	failures map[string][]int
+	requests map[string]int
+	windows  map[string]*window
+	now      func() time.Time
+}
+
+type window struct {
+	remaining int
+	reset     time.Time
+}
+
+// NewServer starts a server that has no users. It is closed with Close.
+func NewServer() *Server {
+	s := &Server{
+		Window:   15 * time.Minute,
+		users:    make(map[string]*User),
+		tweets:   make(map[string][]Tweet),
+		lists:    make(map[string][]string),
+		failures: make(map[string][]int),
+		requests: make(map[string]int),
+		windows:  make(map[string]*window),
+		now:      time.Now,
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// AddUser adds a user or replaces the one with the same id
+func (s *Server) AddUser(user User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[user.Id] = &user
+}
+
+// AddTweets adds tweets to the timeline of the user with userId
+func (s *Server) AddTweets(userId string, tweets ...Tweet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, tweet := range tweets {
+		tweet.AuthorId = userId
+		s.tweets[userId] = append(s.tweets[userId], tweet)
+	}
+	timeline := s.tweets[userId]
+	sort.Slice(timeline, func(i, j int) bool {
+		return isOlder(timeline[j].Id, timeline[i].Id)
+	})
+}
+
+// SetListMembers makes the users with userIds the members of the list with listId, in that order
+func (s *Server) SetListMembers(listId string, userIds ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lists[listId] = append([]string(nil), userIds...)
+}
+
+// FailNext answers the next times requests to endpoint with statusCode, after any failures already planned
+func (s *Server) FailNext(endpoint string, statusCode int, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < times; i++ {
+		s.failures[endpoint] = append(s.failures[endpoint], statusCode)
+	}
+}
+
+// Requests returns the number of requests received for endpoint, including those refused
+func (s *Server) Requests(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[endpoint]
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	endpoint, params := route(r.URL.Path)
+	if len(endpoint) == 0 {
+		writeProblem(w, http.StatusNotFound, "Not Found", "no such endpoint")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[endpoint]++
+	if endpoint == EndpointToken {
+		s.serveToken(w, r)
+		return
+	}
+	if len(s.Bearer) > 0 && r.Header.Get("Authorization") != "Bearer "+s.Bearer {
+		writeProblem(w, http.StatusUnauthorized, "Unauthorized", "Unauthorized")
+		return
+	}
+	if !s.takeRateLimit(w, endpoint) {
+		writeProblem(w, http.StatusTooManyRequests, "Too Many Requests", "Too Many Requests")
+		return
+	}
+	if failures := s.failures[endpoint]; len(failures) > 0 {
+		s.failures[endpoint] = failures[1:]
+		writeProblem(w, failures[0], http.StatusText(failures[0]), "failure planned by the test")
+		return
+	}
+	switch endpoint {
+	case EndpointUserByName:
+		s.serveUser(w, "username", params, func(user *User) bool {
+			return strings.EqualFold(user.UserName, params)
+		})
+	case EndpointUserById:
+		s.serveUser(w, "id", params, func(user *User) bool {
+			return user.Id == params
+		})
+	case EndpointUsersByName:
+		s.serveUsers(w, r)
+	case EndpointUserTweets:
+		s.serveTweets(w, r, params)
+	case EndpointListMembers:
+		s.serveListMembers(w, r, params)
+	}
+}
+
+// route returns the endpoint of path and its path parameter
+func route(path string) (string, string) {
+	switch {
+	case path == EndpointToken:
+		return EndpointToken, ""
+	case path == EndpointUsersByName:
+		return EndpointUsersByName, ""
+	case strings.HasPrefix(path, "/2/lists/") && strings.HasSuffix(path, "/members"):
+		return EndpointListMembers, strings.TrimSuffix(strings.TrimPrefix(path, "/2/lists/"), "/members")
+	case strings.HasPrefix(path, "/2/users/by/username/"):
+		return EndpointUserByName, strings.TrimPrefix(path, "/2/users/by/username/")
+	case strings.HasPrefix(path, "/2/users/") && strings.HasSuffix(path, "/tweets"):
+		return EndpointUserTweets, strings.TrimSuffix(strings.TrimPrefix(path, "/2/users/"), "/tweets")
+	case strings.HasPrefix(path, "/2/users/") && !strings.Contains(strings.TrimPrefix(path, "/2/users/"), "/"):
+		return EndpointUserById, strings.TrimPrefix(path, "/2/users/")
+	}
+	return "", ""
+}
+
+// takeRateLimit sets the rate limit headers and returns false if the budget of endpoint is spent
+func (s *Server) takeRateLimit(w http.ResponseWriter, endpoint string) bool {
+	if s.RateLimit == 0 {
+		return true
+	}
+	current, ok := s.windows[endpoint]
+	if !ok || !s.now().Before(current.reset) {
+		current = &window{remaining: s.RateLimit, reset: s.now().Add(s.Window)}
+		s.windows[endpoint] = current
+	}
+	allowed := current.remaining > 0
+	if allowed {
+		current.remaining--
+	}
+	w.Header().Set("x-rate-limit-limit", strconv.Itoa(s.RateLimit))
+	w.Header().Set("x-rate-limit-remaining", strconv.Itoa(current.remaining))
+	w.Header().Set("x-rate-limit-reset", strconv.FormatInt(current.reset.Unix(), 10))
+	return allowed
+}
+
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request) {
+	key, secret, ok := r.BasicAuth()
+	if r.Method != "POST" || !ok || r.FormValue("grant_type") != "client_credentials" ||
+		key != url.QueryEscape(s.ConsumerKey) || secret != url.QueryEscape(s.ConsumerSecret) {
+		writeJson(w, http.StatusForbidden, map[string]interface{}{"errors": []map[string]interface{}{
+			{"code": 99, "label": "authenticity_token_error", "message": "Unable to verify your credentials"},
+		}})
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]string{"token_type": "bearer", "access_token": s.Bearer})
+}
+
+func (s *Server) serveUser(w http.ResponseWriter, parameter string, value string, matches func(user *User) bool) {
+	for _, user := range s.users {
+		if !matches(user) {
+			continue
+		}
+		if user.Suspended {
+			writeErrors(w, apiError(parameter, value, "Forbidden", fmt.Sprintf("User has been suspended: [%s].", value)))
+			return
+		}
+		writeJson(w, http.StatusOK, map[string]interface{}{"data": user})
+		return
+	}
+	writeErrors(w, apiError(parameter, value, "Not Found Error", fmt.Sprintf("Could not find user with %s: [%s].", parameter, value)))
+}
+
+// serveUsers looks up several users by name, answering with the users found and an error for each of the others
+func (s *Server) serveUsers(w http.ResponseWriter, r *http.Request) {
+	userNames := strings.Split(r.URL.Query().Get("usernames"), ",")
+	if len(userNames) > 100 {
+		writeInvalidRequest(w, fmt.Sprintf("The number of values in the `usernames` query parameter list [%d] is not between 1 and 100", len(userNames)))
+		return
+	}
+	var data []*User
+	var errors []map[string]string
+	for _, userName := range userNames {
+		user := s.findUser(userName)
+		switch {
+		case user == nil:
+			errors = append(errors, apiError("usernames", userName, "Not Found Error", fmt.Sprintf("Could not find user with usernames: [%s].", userName)))
+		case user.Suspended:
+			errors = append(errors, apiError("usernames", userName, "Forbidden", fmt.Sprintf("User has been suspended: [%s].", userName)))
+		default:
+			data = append(data, user)
+		}
+	}
+	body := map[string]interface{}{}
+	if len(data) > 0 {
+		body["data"] = data
+	}
+	if len(errors) > 0 {
+		body["errors"] = errors
+	}
+	writeJson(w, http.StatusOK, body)
+}
+
+func (s *Server) findUser(userName string) *User {
+	for _, user := range s.users {
+		if strings.EqualFold(user.UserName, userName) {
+			return user
+		}
+	}
+	return nil
+}
+
+// serveListMembers answers with a page of the members of the list, leaving out those who are suspended as twitter does
+func (s *Server) serveListMembers(w http.ResponseWriter, r *http.Request, listId string) {
+	query := r.URL.Query()
+	memberIds, ok := s.lists[listId]
+	if !ok {
+		notFound := apiError("id", listId, "Not Found Error", fmt.Sprintf("Could not find list with id: [%s].", listId))
+		notFound["resource_type"] = "list"
+		writeErrors(w, notFound)
+		return
+	}
+	maxResults := 100
+	if value := query.Get("max_results"); len(value) > 0 {
+		var err error
+		maxResults, err = strconv.Atoi(value)
+		if err != nil || maxResults < 1 || maxResults > 100 {
+			writeInvalidRequest(w, fmt.Sprintf("The `max_results` query parameter value [%s] is not between 1 and 100", value))
+			return
+		}
+	}
+	var members []*User
+	for _, userId := range memberIds {
+		if user, ok := s.users[userId]; ok && !user.Suspended {
+			members = append(members, user)
+		}
+	}
+	skip := 0
+	if token := query.Get("pagination_token"); len(token) > 0 {
+		var err error
+		skip, err = strconv.Atoi(strings.TrimPrefix(token, nextTokenPrefix))
+		if err != nil || !strings.HasPrefix(token, nextTokenPrefix) || skip > len(members) {
+			writeInvalidRequest(w, fmt.Sprintf("The `pagination_token` query parameter value [%s] is not valid", token))
+			return
+		}
+	}
+	page := members[skip:]
+	meta := map[string]interface{}{}
+	if len(page) > maxResults {
+		page = page[:maxResults]
+		meta["next_token"] = nextTokenPrefix + strconv.Itoa(skip+maxResults)
+	}
+	meta["result_count"] = len(page)
+	body := map[string]interface{}{"meta": meta}
+	if len(page) > 0 {
+		body["data"] = page
+	}
+	writeJson(w, http.StatusOK, body)
+}
+
+func (s *Server) serveTweets(w http.ResponseWriter, r *http.Request, userId string) {
+	query := r.URL.Query()
+	user, ok := s.users[userId]
+	if !ok {
+		writeErrors(w, apiError("id", userId, "Not Found Error", fmt.Sprintf("Could not find user with id: [%s].", userId)))
+		return
+	}
+	if user.Suspended {
+		writeErrors(w, apiError("id", userId, "Forbidden", fmt.Sprintf("User has been suspended: [%s].", userId)))
+		return
+	}
+	maxResults := 10
+	if value := query.Get("max_results"); len(value) > 0 {
+		var err error
+		maxResults, err = strconv.Atoi(value)
+		if err != nil || maxResults < 5 || maxResults > 100 {
+			writeInvalidRequest(w, fmt.Sprintf("The `max_results` query parameter value [%s] is not between 5 and 100", value))
+			return
+		}
+	}
+	var startTime, endTime time.Time
+	for _, bound := range []struct {
+		name  string
+		value *time.Time
+	}{{"start_time", &startTime}, {"end_time", &endTime}} {
+		if value := query.Get(bound.name); len(value) > 0 {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				writeInvalidRequest(w, fmt.Sprintf("Invalid '%s':'%s'.", bound.name, value))
+				return
+			}
+			*bound.value = parsed
+		}
+	}
+	sinceId, untilId := query.Get("since_id"), query.Get("until_id")
+	var selected []Tweet
+	for _, tweet := range s.tweets[userId] {
+		if (len(sinceId) > 0 && !isOlder(sinceId, tweet.Id)) || (len(untilId) > 0 && !isOlder(tweet.Id, untilId)) ||
+			(!startTime.IsZero() && tweet.CreatedAt.Before(startTime)) || (!endTime.IsZero() && !tweet.CreatedAt.Before(endTime)) {
+			continue
+		}
+		selected = append(selected, tweet)
+	}
+	skip := 0
+	if token := query.Get("pagination_token"); len(token) > 0 {
+		var err error
+		skip, err = strconv.Atoi(strings.TrimPrefix(token, nextTokenPrefix))
+		if err != nil || !strings.HasPrefix(token, nextTokenPrefix) || skip > len(selected) {
+			writeInvalidRequest(w, fmt.Sprintf("The `pagination_token` query parameter value [%s] is not valid", token))
+			return
+		}
+	}
+	page := selected[skip:]
+	meta := map[string]interface{}{}
+	if len(page) > maxResults {
+		page = page[:maxResults]
+		meta["next_token"] = nextTokenPrefix + strconv.Itoa(skip+maxResults)
+	}
+	meta["result_count"] = len(page)
+	body := map[string]interface{}{"meta": meta}
+	if len(page) > 0 {
+		meta["newest_id"] = page[0].Id
+		meta["oldest_id"] = page[len(page)-1].Id
+		body["data"] = page
+	}
+	writeJson(w, http.StatusOK, body)
+}
+
+func apiError(parameter string, value string, title string, detail string) map[string]string {
+	return map[string]string{
+		"value":         value,
+		"detail":        detail,
+		"title":         title,
+		"resource_type": "user",
+		"parameter":     parameter,
+		"resource_id":   value,
+		"type":          problemResourceNotFound,
+	}
+}
+
+// writeErrors answers like twitter does for missing resources, with status 200 and the errors in the body
+func writeErrors(w http.ResponseWriter, errors ...map[string]string) {
+	writeJson(w, http.StatusOK, map[string]interface{}{"errors": errors})
+}
+
+func writeInvalidRequest(w http.ResponseWriter, message string) {
+	writeJson(w, http.StatusBadRequest, map[string]interface{}{
+		"errors": []map[string]interface{}{{"parameters": map[string]interface{}{}, "message": message}},
+		"title":  "Invalid Request",
+		"detail": "One or more parameters to your request was invalid.",
+		"type":   problemInvalidRequest,
+	})
+}
+
+func writeProblem(w http.ResponseWriter, statusCode int, title string, detail string) {
+	writeJson(w, statusCode, map[string]interface{}{
+		"title":  title,
+		"detail": detail,
+		"type":   "about:blank",
+		"status": statusCode,
+	})
+}
+
+func writeJson(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// isOlder returns whether the tweet with id a was created before the one with id b
+func isOlder(a string, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
@@ -0,0 +1,105 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"mrnakumar.com/poli/constants"
+	"time"
+)
+
+// backfillWaterMark is the oldest tweet id reached by the backfill of a user
+const backfillWaterMark WaterMarkType = "backfill"
+
+// twitter refuses an end_time less than 10 seconds before the request
+const endTimeMargin = time.Minute
+
+// BackfillAllUserTweets
+// runs BackfillUserTweets for every user.
+func (f *Fetcher) BackfillAllUserTweets(ctx context.Context, since time.Time) error {
+	return f.forAllUsers(ctx, nil, func(ctx context.Context, user *User) error {
+		return f.BackfillUserTweets(ctx, user.Name, since)
+	})
+}
+
+// BackfillUserTweets
+// stores the tweets of userName older than those read so far, going back to since, or as far as twitter allows if
+// since is zero. The oldest tweet reached is checkpointed apart from the since id of GetUserTweets, so an interrupted
+// backfill resumes where it stopped.
+func (f *Fetcher) BackfillUserTweets(ctx context.Context, userName string, since time.Time) error {
+	logFailure := func(failure string, err error) {
+		failureMsg := fmt.Sprintf("failed in '%s' for userName '%s'", failure, userName)
+		log.Error().Str(constants.LoggerId, fetcherLoggerId).Err(err).Msg(failureMsg)
+	}
+	user, err := f.findUser(ctx, userName)
+	if err != nil {
+		logFailure("getting user", err)
+		return err
+	}
+	untilId, err := f.Store.GetWaterMark(ctx, user.Id, backfillWaterMark)
+	if err != nil {
+		return err
+	}
+	oldestId, err := f.Store.GetOldestTweetId(ctx, user.Id)
+	if err != nil {
+		return err
+	}
+	if len(untilId) == 0 || (len(oldestId) > 0 && isOlder(oldestId, untilId)) {
+		untilId = oldestId
+	}
+	var endTime, startTime string
+	if len(untilId) == 0 {
+		// nothing is stored yet, so start from now
+		endTime = time.Now().UTC().Add(-endTimeMargin).Format(time.RFC3339)
+	}
+	if !since.IsZero() {
+		startTime = since.UTC().Format(time.RFC3339)
+	}
+	sinceId, err := f.Store.GetWaterMark(ctx, user.Id, tweetWaterMark)
+	if err != nil {
+		return err
+	}
+	backfilled := 0
+	query := TweetsQuery{UntilId: untilId, EndTime: endTime, StartTime: startTime}
+	err = f.TwitterClient.QueryTweetPages(ctx, user.Id, tweetFetchSize, query, "", func(page *TweetsResponse) error {
+		if len(page.Tweets) == 0 {
+			return nil
+		}
+		// each page is older than the one before, so the backfill resumes after the last page stored
+		waterMarks := map[WaterMarkType]string{backfillWaterMark: oldestTweetId(page)}
+		if len(sinceId) == 0 {
+			// so that GetUserTweets continues from the newest tweet rather than read the same tweets again
+			sinceId = newestTweetId(page)
+			waterMarks[tweetWaterMark] = sinceId
+		}
+		backfilled += len(page.Tweets)
+		return f.saveTweets(ctx, user, page.Tweets, waterMarks)
+	})
+	log.Info().Str(constants.LoggerId, fetcherLoggerId).Msgf("backfilled '%d' tweets for userName '%s'",
+		backfilled, userName)
+	if err != nil {
+		logFailure("getting and saving older tweets", err)
+		return err
+	}
+	return nil
+}
+
+func oldestTweetId(response *TweetsResponse) TweetId {
+	oldest := response.Meta.OldestId
+	for _, tweet := range response.Tweets {
+		if len(oldest) == 0 || isOlder(tweet.Id, oldest) {
+			oldest = tweet.Id
+		}
+	}
+	return oldest
+}
+
+func newestTweetId(response *TweetsResponse) TweetId {
+	newest := response.Meta.NewestId
+	for _, tweet := range response.Tweets {
+		if len(newest) == 0 || isOlder(newest, tweet.Id) {
+			newest = tweet.Id
+		}
+	}
+	return newest
+}
@@ -0,0 +1,93 @@
+package fetch
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+const olderTweetsResponseBody = `{
+    "data": [
+        {"id": "999", "text": "nine nine nine", "lang": "en"},
+        {"id": "998", "text": "nine nine eight", "lang": "en"}
+    ],
+    "meta": {"newest_id": "999", "oldest_id": "998", "result_count": 2}
+}`
+
+func newBackfillFetcher(t *testing.T) (*Fetcher, *MemoryStore, *bodyClient) {
+	client := &bodyClient{body: olderTweetsResponseBody}
+	fetcher, store := newTestFetcher(client)
+	if err := store.AddUser(context.Background(), &User{Id: userId, Name: userName}); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	return fetcher, store, client
+}
+
+func TestBackfillFromOldestStoredTweet(t *testing.T) {
+	fetcher, store, client := newBackfillFetcher(t)
+	if _, err := store.SaveTweets(context.Background(), userId, []Tweet{{Id: "1001"}, {Id: "1000"}}); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	_ = store.UpdateWaterMark(context.Background(), userId, tweetWaterMark, "1001")
+	since := time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	if err := fetcher.BackfillUserTweets(context.Background(), userName, since); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	url := client.urls[0]
+	if !strings.Contains(url, "until_id=1000") || !strings.Contains(url, "start_time=2021-01-02T00:00:00Z") ||
+		strings.Contains(url, "end_time") {
+		t.Errorf("url = '%s'; expected until_id of the oldest stored tweet and start_time", url)
+	}
+	if len(store.tweets) != 4 {
+		t.Errorf("stored tweets = %d; expected = 4", len(store.tweets))
+	}
+	if waterMark, _ := store.GetWaterMark(context.Background(), userId, backfillWaterMark); waterMark != "998" {
+		t.Errorf("backfill watermark = '%s'; expected = '998'", waterMark)
+	}
+	if sinceId, _ := store.GetWaterMark(context.Background(), userId, tweetWaterMark); sinceId != "1001" {
+		t.Errorf("since id = '%s'; expected to stay '1001'", sinceId)
+	}
+}
+
+func TestBackfillResumesFromWaterMark(t *testing.T) {
+	fetcher, store, client := newBackfillFetcher(t)
+	if _, err := store.SaveTweets(context.Background(), userId, []Tweet{{Id: "1000"}}); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	// an earlier backfill reached further back than the tweets stored
+	_ = store.UpdateWaterMark(context.Background(), userId, backfillWaterMark, "9990")
+	client.body = `{"meta": {"result_count": 0}}`
+	if err := fetcher.BackfillUserTweets(context.Background(), userName, time.Time{}); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if url := client.urls[0]; !strings.Contains(url, "until_id=1000&") || strings.Contains(url, "start_time") {
+		t.Errorf("url = '%s'; expected until_id of the older stored tweet", url)
+	}
+	if waterMark, _ := store.GetWaterMark(context.Background(), userId, backfillWaterMark); waterMark != "9990" {
+		t.Errorf("backfill watermark = '%s'; expected to stay '9990'", waterMark)
+	}
+}
+
+func TestBackfillWithoutStoredTweets(t *testing.T) {
+	fetcher, store, client := newBackfillFetcher(t)
+	if err := fetcher.BackfillUserTweets(context.Background(), userName, time.Time{}); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if url := client.urls[0]; strings.Contains(url, "until_id") || !strings.Contains(url, "end_time=") {
+		t.Errorf("url = '%s'; expected end_time and no until_id", url)
+	}
+	// the next GetUserTweets continues after the backfilled tweets
+	if sinceId, _ := store.GetWaterMark(context.Background(), userId, tweetWaterMark); sinceId != "999" {
+		t.Errorf("since id = '%s'; expected = '999'", sinceId)
+	}
+}
+
+func TestIsOlder(t *testing.T) {
+	for _, ids := range [][2]TweetId{{"998", "999"}, {"999", "1000"}, {"20", "1301573587187331066"}} {
+		if !isOlder(ids[0], ids[1]) || isOlder(ids[1], ids[0]) {
+			t.Errorf("isOlder(%s, %s) = false; expected true", ids[0], ids[1])
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package fetch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"mrnakumar.com/poli/constants"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sync"
+)
+
+const cassetteLoggerId = "cassette"
+
+// redacted replaces the secrets in a cassette
+const redacted = "REDACTED"
+
+// ErrNotRecorded is returned by a ReplayingClient for a request it has no response left for. It is not retried, as
+// sending the request again cannot find one.
+var ErrNotRecorded = errors.New("no recorded response left")
+
+// accessTokenPattern finds the token in the response of oauth2/token
+var accessTokenPattern = regexp.MustCompile(`"access_token"\s*:\s*"[^"]*"`)
+
+// Interaction
+// is a request and its response as kept in a cassette, one JSON object per line.
+type Interaction struct {
+	Method   string           `json:"method"`
+	Url      string           `json:"url"`
+	Header   http.Header      `json:"header,omitempty"`
+	Body     string           `json:"body,omitempty"`
+	Response RecordedResponse `json:"response"`
+}
+
+type RecordedResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body"`
+}
+
+// RecordingClient
+// sends the requests with Client and writes each of them with its response to a cassette file, so that a run can be
+// replayed with a ReplayingClient. The bearer token and the credentials of oauth2/token are left out. It is safe for
+// concurrent use.
+type RecordingClient struct {
+	Client HttpClient
+	mu     sync.Mutex
+	file   *os.File
+}
+
+// NewRecordingClient creates the cassette at path, replacing any file there
+func NewRecordingClient(client HttpClient, path string) (*RecordingClient, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &RecordingClient{Client: client, file: file}, nil
+}
+
+func (c *RecordingClient) Do(req *http.Request) (*http.Response, error) {
+	interaction := Interaction{Method: req.Method, Url: req.URL.String(), Header: req.Header.Clone()}
+	interaction.Header.Del("Authorization")
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		interaction.Body = string(body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	res, err := c.Client.Do(req)
+	if err != nil {
+		// a failure to send is not replayed, the request is sent again instead
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	closeOrLogWarningIfFailed(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	interaction.Response = RecordedResponse{
+		StatusCode: res.StatusCode,
+		Header:     res.Header.Clone(),
+		Body:       accessTokenPattern.ReplaceAllString(string(body), fmt.Sprintf(`"access_token":"%s"`, redacted)),
+	}
+	c.record(interaction)
+	return res, nil
+}
+
+// record appends interaction to the cassette. A failure is only logged as the run does not depend on it.
+func (c *RecordingClient) record(interaction Interaction) {
+	line, err := json.Marshal(interaction)
+	if err == nil {
+		c.mu.Lock()
+		_, err = c.file.Write(append(line, '\n'))
+		c.mu.Unlock()
+	}
+	if err != nil {
+		log.Error().Str(constants.LoggerId, cassetteLoggerId).Err(err).Msgf("failed to record response for url '%s'", interaction.Url)
+	}
+}
+
+// Close closes the cassette
+func (c *RecordingClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.file.Close()
+}
+
+// ReplayingClient
+// answers the requests with the responses of a cassette written by a RecordingClient, without the network. The
+// responses for the same method and url are given in the order they were recorded, which keeps the order of the
+// pages of a timeline even if users were fetched concurrently. Running out of responses is an error. It is safe for
+// concurrent use.
+type ReplayingClient struct {
+	mu           sync.Mutex
+	interactions map[string][]Interaction
+}
+
+func NewReplayingClient(path string) (*ReplayingClient, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	c := &ReplayingClient{interactions: make(map[string][]Interaction)}
+	scanner := bufio.NewScanner(file)
+	// a page of tweets is larger than the default limit of a line
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var interaction Interaction
+		if err = json.Unmarshal(scanner.Bytes(), &interaction); err != nil {
+			return nil, fmt.Errorf("invalid interaction at line '%d' of cassette '%s': %w", line, path, err)
+		}
+		key := interactionKey(interaction.Method, interaction.Url)
+		c.interactions[key] = append(c.interactions[key], interaction)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *ReplayingClient) Do(req *http.Request) (*http.Response, error) {
+	key := interactionKey(req.Method, req.URL.String())
+	c.mu.Lock()
+	recorded := c.interactions[key]
+	if len(recorded) == 0 {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("%w for '%s'", ErrNotRecorded, key)
+	}
+	c.interactions[key] = recorded[1:]
+	c.mu.Unlock()
+	response := recorded[0].Response
+	return &http.Response{
+		StatusCode: response.StatusCode,
+		Header:     response.Header,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(response.Body))),
+		Request:    req,
+	}, nil
+}
+
+// Remaining returns the number of recorded responses not replayed yet
+func (c *ReplayingClient) Remaining() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	count := 0
+	for _, recorded := range c.interactions {
+		count += len(recorded)
+	}
+	return count
+}
+
+// interactionKey
+// identifies the requests answered alike. The start_time and end_time of a timeline are left out as they are computed
+// from the time of the run, for new users and for the first backfill of a user.
+func interactionKey(method string, rawUrl string) string {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return method + " " + rawUrl
+	}
+	query := parsed.Query()
+	query.Del("start_time")
+	query.Del("end_time")
+	parsed.RawQuery = query.Encode()
+	return method + " " + parsed.String()
+}
@@ -0,0 +1,150 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	server, fetcher, store := newFakeTwitter(t, 150)
+	server.ConsumerKey, server.ConsumerSecret = "key", "secret"
+	cassette := filepath.Join(t.TempDir(), "run.jsonl")
+	recorder, err := NewRecordingClient(server.Client(), cassette)
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	tokens := NewAppTokenSource("key", "secret", recorder)
+	tokens.BaseUrl = server.URL
+	fetcher.TwitterClient.Client = recorder
+	fetcher.TwitterClient.Bearer = ""
+	fetcher.TwitterClient.Tokens = tokens
+	if err = fetcher.AddUser(context.Background(), fakeUserName); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if err = fetcher.GetAllUserTweets(context.Background()); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if err = recorder.Close(); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	recorded, _ := ioutil.ReadFile(cassette)
+	if strings.Contains(string(recorded), fakeBearer) || strings.Contains(string(recorded), "Basic ") {
+		t.Errorf("cassette has credentials: %s", recorded)
+	}
+
+	server.Close()
+	replayer, err := NewReplayingClient(cassette)
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	replayed := NewMemoryStore()
+	user, _ := store.GetUser(context.Background(), fakeUserName)
+	_ = replayed.AddUser(context.Background(), user)
+	// the token is replayed too, redacted
+	tokens = NewAppTokenSource("key", "secret", replayer)
+	tokens.BaseUrl = server.URL
+	replay := &Fetcher{
+		TwitterClient: HttpTwitterClient{BaseUrl: server.URL, Tokens: tokens, Client: replayer},
+		Store:         replayed,
+	}
+	if err = replay.GetAllUserTweets(context.Background()); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if len(replayed.tweets) != len(store.tweets) {
+		t.Errorf("replayed tweets = %d; expected = %d", len(replayed.tweets), len(store.tweets))
+	}
+	if remaining := replayer.Remaining(); remaining != 1 {
+		// the user lookup of AddUser is left
+		t.Errorf("remaining responses = %d; expected = 1", remaining)
+	}
+	if err = replay.GetUserTweets(context.Background(), fakeUserName); err == nil {
+		t.Errorf("Error = nil; expected no recorded response left")
+	}
+}
+
+func TestReplayInvalidCassette(t *testing.T) {
+	cassette := filepath.Join(t.TempDir(), "run.jsonl")
+	if err := ioutil.WriteFile(cassette, []byte("{not json\n"), 0600); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if _, err := NewReplayingClient(cassette); err == nil || !strings.Contains(err.Error(), "line '1'") {
+		t.Errorf("Error = %v; expected invalid interaction at line '1'", err)
+	}
+}
+
+func TestReplayBackfill(t *testing.T) {
+	server, fetcher, store := newFakeTwitter(t, 150)
+	cassette := filepath.Join(t.TempDir(), "backfill.jsonl")
+	recorder, err := NewRecordingClient(server.Client(), cassette)
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	fetcher.TwitterClient.Client = recorder
+	if err = fetcher.AddUser(context.Background(), fakeUserName); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	// nothing is stored yet, so the backfill starts from an end_time of the time of the run
+	if err = fetcher.BackfillUserTweets(context.Background(), fakeUserName, time.Time{}); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if err = recorder.Close(); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	// as if the cassette had been recorded earlier
+	recorded, _ := ioutil.ReadFile(cassette)
+	endTime := regexp.MustCompile(`end_time=[0-9T:Z-]+`)
+	if !endTime.Match(recorded) {
+		t.Fatalf("cassette has no end_time: %s", recorded)
+	}
+	recorded = endTime.ReplaceAll(recorded, []byte("end_time=2020-01-02T03:04:05Z"))
+	if err = ioutil.WriteFile(cassette, recorded, 0600); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+
+	server.Close()
+	replayer, err := NewReplayingClient(cassette)
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	replayed := NewMemoryStore()
+	user, _ := store.GetUser(context.Background(), fakeUserName)
+	_ = replayed.AddUser(context.Background(), user)
+	replay := &Fetcher{TwitterClient: HttpTwitterClient{BaseUrl: server.URL, Client: replayer}, Store: replayed}
+	if err = replay.BackfillUserTweets(context.Background(), fakeUserName, time.Time{}); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if len(store.tweets) == 0 || len(replayed.tweets) != len(store.tweets) {
+		t.Errorf("replayed tweets = %d; expected = %d", len(replayed.tweets), len(store.tweets))
+	}
+}
+
+func TestReplayMissIsNotRetried(t *testing.T) {
+	cassette := filepath.Join(t.TempDir(), "empty.jsonl")
+	if err := ioutil.WriteFile(cassette, nil, 0600); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	replayer, err := NewReplayingClient(cassette)
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	retry := DefaultRetryPolicy()
+	waits := 0
+	retry.sleep = func(ctx context.Context, d time.Duration) error {
+		waits++
+		return nil
+	}
+	fetcher := &Fetcher{TwitterClient: HttpTwitterClient{Client: replayer, Retry: retry}, Store: NewMemoryStore()}
+	err = fetcher.AddUser(context.Background(), fakeUserName)
+	if !errors.Is(err, ErrNotRecorded) || !strings.Contains(err.Error(), fakeUserName) {
+		t.Errorf("Error = %v; expected %v naming the request", err, ErrNotRecorded)
+	}
+	if waits != 0 {
+		t.Errorf("waits = %d; expected none", waits)
+	}
+}
@@ -0,0 +1,68 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+)
+
+// WaterMarkKinds are all the kinds of checkpoints kept for a user
+var WaterMarkKinds = []WaterMarkType{tweetWaterMark, tweetNextTokenWaterMark, tweetNewestWaterMark,
+	tweetStartTimeWaterMark, backfillWaterMark}
+
+// GetWaterMarks
+// returns the checkpoints of userName by kind. Kinds without a checkpoint are left out.
+func (f *Fetcher) GetWaterMarks(ctx context.Context, userName string) (map[WaterMarkType]string, error) {
+	user, err := f.findUser(ctx, userName)
+	if err != nil {
+		return nil, err
+	}
+	waterMarks := make(map[WaterMarkType]string)
+	for _, kind := range WaterMarkKinds {
+		waterMark, err := f.Store.GetWaterMark(ctx, user.Id, kind)
+		if err != nil {
+			return nil, err
+		}
+		if len(waterMark) > 0 {
+			waterMarks[kind] = waterMark
+		}
+	}
+	return waterMarks, nil
+}
+
+// ResetWaterMarks
+// clears the given kinds of checkpoints of userName, or all of them if kinds is empty, so that the tweets are read
+// again as for a new user.
+func (f *Fetcher) ResetWaterMarks(ctx context.Context, userName string, kinds []WaterMarkType) error {
+	user, err := f.findUser(ctx, userName)
+	if err != nil {
+		return err
+	}
+	if len(kinds) == 0 {
+		kinds = WaterMarkKinds
+	}
+	txn, err := f.Store.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer rollbackOrLog(txn)
+	for _, kind := range kinds {
+		if !IsWaterMarkKind(kind) {
+			return fmt.Errorf("unknown checkpoint kind '%s'", kind)
+		}
+		err = txn.UpdateWaterMark(ctx, user.Id, kind, "")
+		if err != nil {
+			return err
+		}
+	}
+	return txn.Commit()
+}
+
+// IsWaterMarkKind returns whether kind is one of WaterMarkKinds
+func IsWaterMarkKind(kind WaterMarkType) bool {
+	for _, known := range WaterMarkKinds {
+		if kind == known {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"mrnakumar.com/poli/constants"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const credentialPoolLoggerId = "credential_pool"
+
+// CredentialPool
+// spreads the requests over several credentials, such as the bearer tokens of twitter projects with separate rate
+// limits. The credentials are taken in turn, skipping those whose rate limit for the endpoint is exhausted and those
+// twitter revoked. It is safe for concurrent use.
+type CredentialPool struct {
+	mu          sync.Mutex
+	credentials []*credential
+	// next is the index of the credential to try first
+	next  int
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+type credential struct {
+	name string
+	// bearer is used if tokens is nil
+	bearer      string
+	tokens      TokenSource
+	limits      *RateLimiter
+	revoked     bool
+	requests    map[string]int
+	rateLimited int
+}
+
+// CredentialUsage
+// reports the use of a credential of a CredentialPool.
+type CredentialUsage struct {
+	Name string
+	// Requests counts the requests sent with the credential by endpoint
+	Requests map[string]int
+	// RateLimited counts the requests twitter refused for the rate limit
+	RateLimited int
+	Revoked     bool
+	RateLimits  map[string]RateLimit
+}
+
+func NewCredentialPool() *CredentialPool {
+	return &CredentialPool{now: time.Now, sleep: sleepContext}
+}
+
+// AddBearer adds a bearer token. The name identifies it in the logs and the usage, as the token is a secret.
+func (p *CredentialPool) AddBearer(name string, bearer string) {
+	p.add(&credential{name: name, bearer: bearer})
+}
+
+// AddTokens adds the tokens of an app, such as an AppTokenSource
+func (p *CredentialPool) AddTokens(name string, tokens TokenSource) {
+	p.add(&credential{name: name, tokens: tokens})
+}
+
+func (p *CredentialPool) add(cred *credential) {
+	cred.limits = NewRateLimiter()
+	cred.limits.now = p.now
+	cred.requests = make(map[string]int)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.credentials = append(p.credentials, cred)
+}
+
+// Usage returns the use of each credential in the order they were added
+func (p *CredentialPool) Usage() []CredentialUsage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	usage := make([]CredentialUsage, 0, len(p.credentials))
+	for _, cred := range p.credentials {
+		requests := make(map[string]int, len(cred.requests))
+		for endpoint, count := range cred.requests {
+			requests[endpoint] = count
+		}
+		usage = append(usage, CredentialUsage{
+			Name:        cred.name,
+			Requests:    requests,
+			RateLimited: cred.rateLimited,
+			Revoked:     cred.revoked,
+			RateLimits:  cred.limits.All(),
+		})
+	}
+	return usage
+}
+
+// acquire
+// returns the next credential with budget left for endpoint, taking one request out of it. If every credential is
+// exhausted it waits for the first one to reset. It fails once all the credentials are revoked.
+func (p *CredentialPool) acquire(ctx context.Context, endpoint string) (*credential, error) {
+	for {
+		p.mu.Lock()
+		live := 0
+		shortestWait := time.Duration(0)
+		for i := range p.credentials {
+			index := (p.next + i) % len(p.credentials)
+			cred := p.credentials[index]
+			if cred.revoked {
+				continue
+			}
+			live++
+			wait := cred.limits.tryAcquire(endpoint)
+			if wait == 0 {
+				p.next = (index + 1) % len(p.credentials)
+				cred.requests[endpoint]++
+				p.mu.Unlock()
+				return cred, nil
+			}
+			if shortestWait == 0 || wait < shortestWait {
+				shortestWait = wait
+			}
+		}
+		count := len(p.credentials)
+		p.mu.Unlock()
+		if live == 0 {
+			return nil, fmt.Errorf("none of the '%d' credentials is left: %w", count, ErrUnauthorized)
+		}
+		log.Info().Str(constants.LoggerId, credentialPoolLoggerId).
+			Msgf("rate limit of '%s' exhausted for all the '%d' credentials, waiting '%s' for reset", endpoint, live, shortestWait)
+		if err := p.sleep(ctx, shortestWait); err != nil {
+			return nil, fmt.Errorf("gave up waiting for the rate limit of '%s': %w", endpoint, err)
+		}
+	}
+}
+
+// revoke
+// stops using cred after twitter rejected it and returns whether any credential is left.
+func (p *CredentialPool) revoke(cred *credential) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cred.revoked = true
+	for _, other := range p.credentials {
+		if !other.revoked {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *CredentialPool) rateLimited(cred *credential, endpoint string, header http.Header) {
+	p.mu.Lock()
+	cred.rateLimited++
+	p.mu.Unlock()
+	cred.limits.exhausted(endpoint, header)
+}
+
+// do
+// sends a GET request for url with a credential of the pool. A request refused for the rate limit is sent again with
+// another credential, or the same one after its reset. A rejected credential is revoked and the request is sent again
+// with another one, the last rejection is returned.
+func (p *CredentialPool) do(ctx context.Context, c *HttpTwitterClient, endpoint string, url string) (*http.Response, error) {
+	p.mu.Lock()
+	maxAttempts := maxRateLimitedAttempts * len(p.credentials)
+	p.mu.Unlock()
+	for attempt := 1; ; attempt++ {
+		cred, err := p.acquire(ctx, endpoint)
+		if err != nil {
+			return nil, err
+		}
+		withCredential := *c
+		withCredential.Bearer = cred.bearer
+		withCredential.Tokens = cred.tokens
+		res, err := doAuthorized(ctx, &withCredential, url)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case res.StatusCode == http.StatusUnauthorized:
+			log.Error().Str(constants.LoggerId, credentialPoolLoggerId).Msgf("twitter rejected credential '%s', no longer using it", cred.name)
+			if !p.revoke(cred) {
+				return res, nil
+			}
+		case res.StatusCode == http.StatusTooManyRequests && attempt < maxAttempts:
+			log.Warn().Str(constants.LoggerId, credentialPoolLoggerId).Msgf("credential '%s' rate limited for url '%s'", cred.name, url)
+			p.rateLimited(cred, endpoint, res.Header)
+		default:
+			cred.limits.update(endpoint, res.Header)
+			return res, nil
+		}
+		closeOrLogWarningIfFailed(res.Body)
+	}
+}
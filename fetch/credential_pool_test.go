@@ -0,0 +1,148 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tokenClient
+// answers the user lookup with the status code set for the bearer token of the request, 200 by default, and counts
+// the requests of each token.
+type tokenClient struct {
+	mu       sync.Mutex
+	statuses map[string]int
+	// header is sent with every response
+	header   http.Header
+	requests map[string]int
+}
+
+func newTokenClient() *tokenClient {
+	return &tokenClient{statuses: make(map[string]int), header: make(http.Header), requests: make(map[string]int)}
+}
+
+func (c *tokenClient) Do(req *http.Request) (*http.Response, error) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests[token]++
+	status, ok := c.statuses[token]
+	if !ok {
+		status = http.StatusOK
+	}
+	body := user
+	if status != http.StatusOK {
+		body = `{"title": "failed"}`
+	}
+	return &http.Response{StatusCode: status, Header: c.header.Clone(), Body: ioutil.NopCloser(bytes.NewReader([]byte(body)))}, nil
+}
+
+func newPool(bearers ...string) *CredentialPool {
+	pool := NewCredentialPool()
+	for _, bearer := range bearers {
+		pool.AddBearer("name-"+bearer, bearer)
+	}
+	return pool
+}
+
+func TestCredentialPoolRotates(t *testing.T) {
+	client := newTokenClient()
+	pool := newPool("a", "b", "c")
+	twitterClient := HttpTwitterClient{Credentials: pool, Client: client}
+	for i := 0; i < 6; i++ {
+		if _, err := twitterClient.FindUser(context.Background(), userName); err != nil {
+			t.Fatalf("Error = %v; expected nil", err)
+		}
+	}
+	for _, bearer := range []string{"a", "b", "c"} {
+		if client.requests[bearer] != 2 {
+			t.Errorf("requests of %s = %d; expected = 2", bearer, client.requests[bearer])
+		}
+	}
+	for _, usage := range pool.Usage() {
+		if usage.Requests[EndpointUserByName] != 2 {
+			t.Errorf("reported requests of %s = %d; expected = 2", usage.Name, usage.Requests[EndpointUserByName])
+		}
+	}
+}
+
+func TestCredentialPoolSkipsRateLimitedToken(t *testing.T) {
+	client := newTokenClient()
+	client.statuses["a"] = http.StatusTooManyRequests
+	pool := newPool("a", "b")
+	twitterClient := HttpTwitterClient{Credentials: pool, Client: client}
+	for i := 0; i < 3; i++ {
+		if _, err := twitterClient.FindUser(context.Background(), userName); err != nil {
+			t.Fatalf("Error = %v; expected nil", err)
+		}
+	}
+	if client.requests["a"] != 1 || client.requests["b"] != 3 {
+		t.Errorf("requests of a, b = %d, %d; expected = 1, 3", client.requests["a"], client.requests["b"])
+	}
+	if usage := pool.Usage()[0]; usage.RateLimited != 1 || usage.Revoked {
+		t.Errorf("usage of a = %+v; expected rate limited once", usage)
+	}
+}
+
+func TestCredentialPoolRevokesRejectedToken(t *testing.T) {
+	client := newTokenClient()
+	client.statuses["a"] = http.StatusUnauthorized
+	pool := newPool("a", "b")
+	twitterClient := HttpTwitterClient{Credentials: pool, Client: client}
+	for i := 0; i < 2; i++ {
+		if _, err := twitterClient.FindUser(context.Background(), userName); err != nil {
+			t.Fatalf("Error = %v; expected nil", err)
+		}
+	}
+	if client.requests["a"] != 1 {
+		t.Errorf("requests of a = %d; expected = 1", client.requests["a"])
+	}
+	if !pool.Usage()[0].Revoked {
+		t.Errorf("a is not revoked")
+	}
+
+	client.statuses["b"] = http.StatusUnauthorized
+	_, err := twitterClient.FindUser(context.Background(), userName)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Error = %v; expected %v", err, ErrUnauthorized)
+	}
+	_, err = twitterClient.FindUser(context.Background(), userName)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Error = %v; expected %v", err, ErrUnauthorized)
+	}
+}
+
+func TestCredentialPoolWaitsWhenAllExhausted(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	client := newTokenClient()
+	client.header.Set(headerRateLimit, "1")
+	client.header.Set(headerRateLimitRemaining, "0")
+	client.header.Set(headerRateLimitReset, strconv.FormatInt(now.Add(time.Minute).Unix(), 10))
+	pool := newPool("a", "b")
+	var waits []time.Duration
+	pool.now = func() time.Time { return now }
+	pool.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		now = now.Add(d)
+		return nil
+	}
+	for _, cred := range pool.credentials {
+		cred.limits.now = pool.now
+	}
+	twitterClient := HttpTwitterClient{Credentials: pool, Client: client}
+	for i := 0; i < 3; i++ {
+		if _, err := twitterClient.FindUser(context.Background(), userName); err != nil {
+			t.Fatalf("Error = %v; expected nil", err)
+		}
+	}
+	if len(waits) != 1 || waits[0] != time.Minute+rateLimitResetMargin {
+		t.Errorf("waits = %v; expected = [%s]", waits, time.Minute+rateLimitResetMargin)
+	}
+}
@@ -1,44 +1,90 @@
 package fetch
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"github.com/lib/pq"
 	"github.com/rs/zerolog/log"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
-
-	_ "github.com/lib/pq"
+	"time"
 )
 
+// Database
+// is the Store backed by a SQL database. Postgres and SQLite are supported.
 type Database struct {
-	DB *sql.DB
+	DB     *sql.DB
+	driver string
 }
 
 const dsLoggerId = "datastore"
+const driverPostgres = "postgres"
+
+// All the statements take their values as parameters. The placeholders are understood by both Postgres and SQLite,
+// which numbers them by the order they first appear in rather than by their number, so they must appear in order.
+const (
+	selectUsers           = "SELECT id, name, profile_image, display_name, description, location, url, verified, protected FROM users"
+	selectUserByName      = selectUsers + " WHERE name = $1"
+	selectUserByLowerName = selectUsers + " WHERE lower(name) = lower($1)"
+	insertUser            = "INSERT INTO users (id, name, profile_image, display_name, description, location, url, verified, protected) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
+	updateUser            = "UPDATE users SET name = $1, profile_image = $2, display_name = $3, description = $4, location = $5, url = $6, verified = $7, protected = $8 WHERE id = $9"
+	insertProfileChange   = "INSERT INTO user_profile_history (user_id, field, old_value, new_value, changed_at) VALUES ($1, $2, $3, $4, $5)"
+	selectProfileHistory  = "SELECT user_id, field, old_value, new_value, changed_at FROM user_profile_history WHERE user_id = $1 ORDER BY changed_at, field"
+	upsertCheckpoint      = "INSERT INTO checkpoint (user_id, type, watermark) VALUES ($1, $2, $3) ON CONFLICT (user_id, type) DO UPDATE SET watermark = $3"
+	selectCheckpoint      = "SELECT watermark FROM checkpoint WHERE user_id = $1 AND type = $2"
+	// ids are numbers which grow with time, compared as strings they are ordered by length first
+	selectOldestTweetId   = "SELECT id FROM tweets WHERE user_id = $1 ORDER BY length(id), id LIMIT 1"
+	selectTweetIds        = "SELECT id FROM tweets WHERE id IN (%s)"
+	deleteTweetReferences = "DELETE FROM tweet_references WHERE tweet_id = $1"
+	deleteTweetEntities   = "DELETE FROM tweet_entities WHERE tweet_id = $1"
+	selectListMembers     = "SELECT list_id, user_id, joined_at, left_at FROM list_members WHERE list_id = $1 ORDER BY joined_at, user_id"
+	upsertListMember      = "INSERT INTO list_members (list_id, user_id, joined_at) VALUES ($1, $2, $3) ON CONFLICT (list_id, user_id) DO UPDATE SET joined_at = $3, left_at = NULL"
+	updateListMemberLeft  = "UPDATE list_members SET left_at = $1 WHERE list_id = $2 AND user_id = $3"
+)
 
 var db *Database
 var lock = new(sync.Mutex)
 
-func GetDb(host string, userName string, password string, dbName string, forTest bool) *Database {
+// GetDb
+// returns an in memory store if forTest is true, otherwise the Postgres store for the given connection details. The
+// default sslmode of Postgres, 'prefer', is used if sslMode is empty.
+func GetDb(host string, userName string, password string, dbName string, sslMode string, forTest bool) Store {
 	if forTest {
-		panic("datastore for testing is not yet implemented")
+		return NewMemoryStore()
 	}
 	lock.Lock()
 	defer lock.Unlock()
 	if db == nil {
-		connStr := fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=disable", userName, password, host, dbName)
-		handle, err := sql.Open("postgres", connStr)
+		connStr := url.URL{Scheme: "postgres", User: url.UserPassword(userName, password), Host: host, Path: "/" + dbName}
+		if len(sslMode) > 0 {
+			connStr.RawQuery = url.Values{"sslmode": {sslMode}}.Encode()
+		}
+		handle, err := openDatabase(driverPostgres, connStr.String())
 		if err != nil {
 			panic(err)
 		}
-		db = &Database{
-			DB: handle,
-		}
+		db = handle
 	}
 	return db
 }
 
-func (ds *Database) GetAllUsers() ([]*User, error) {
-	rows, err := ds.DB.Query("SELECT * FROM users")
+func openDatabase(driver string, dataSourceName string) (*Database, error) {
+	handle, err := sql.Open(driver, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	return &Database{
+		DB:     handle,
+		driver: driver,
+	}, nil
+}
+
+func (ds *Database) GetAllUsers(ctx context.Context) ([]*User, error) {
+	rows, err := ds.DB.QueryContext(ctx, selectUsers)
 	if err != nil {
 		return nil, err
 	}
@@ -57,8 +103,16 @@ func (ds *Database) GetAllUsers() ([]*User, error) {
 	return users, nil
 }
 
-func (ds *Database) GetUser(userName string) (*User, error) {
-	rows, err := ds.DB.Query(fmt.Sprintf("SELECT * FROM users where name LIKE '%s'", userName))
+func (ds *Database) GetUser(ctx context.Context, userName string) (*User, error) {
+	return ds.queryUser(ctx, selectUserByName, userName)
+}
+
+func (ds *Database) GetUserIgnoringCase(ctx context.Context, userName string) (*User, error) {
+	return ds.queryUser(ctx, selectUserByLowerName, userName)
+}
+
+func (ds *Database) queryUser(ctx context.Context, query string, args ...interface{}) (*User, error) {
+	rows, err := ds.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -73,14 +127,411 @@ func (ds *Database) GetUser(userName string) (*User, error) {
 	return scanUser(rows)
 }
 
-func (ds *Database) UpdateSinceId(userId TwitterUserId, kind WaterMarkType, since TweetId) error {
-	query := fmt.Sprintf("INSERT INTO checkpoint VALUES ('%s', '%s', '%s') ON CONFLICT(user_id, type) DO UPDATE SET watermark = '%s' ", userId, kind, since, since)
-	_, err := ds.DB.Exec(query)
+func (ds *Database) AddUser(ctx context.Context, user *User) error {
+	_, err := ds.DB.ExecContext(ctx, insertUser, user.Id, user.Name, nullIfEmpty(user.ProfilePictureUrl),
+		nullIfEmpty(user.DisplayName), nullIfEmpty(user.Description), nullIfEmpty(user.Location), nullIfEmpty(user.Url),
+		user.Verified, user.Protected)
+	return err
+}
+
+func (ds *Database) UpdateUser(ctx context.Context, user *User, changes []ProfileChange) error {
+	txn, err := ds.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	result, err := txn.ExecContext(ctx, updateUser, user.Name, nullIfEmpty(user.ProfilePictureUrl),
+		nullIfEmpty(user.DisplayName), nullIfEmpty(user.Description), nullIfEmpty(user.Location), nullIfEmpty(user.Url),
+		user.Verified, user.Protected, user.Id)
+	if err != nil {
+		rollbackOrLog(txn)
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		rollbackOrLog(txn)
+		return err
+	}
+	if count == 0 {
+		rollbackOrLog(txn)
+		return fmt.Errorf("user with id '%s' does not exist", user.Id)
+	}
+	for _, change := range changes {
+		_, err = txn.ExecContext(ctx, insertProfileChange, change.UserId, change.Field, nullIfEmpty(change.OldValue),
+			nullIfEmpty(change.NewValue), change.ChangedAt.UTC())
+		if err != nil {
+			rollbackOrLog(txn)
+			return err
+		}
+	}
+	return txn.Commit()
+}
+
+func (ds *Database) GetProfileHistory(ctx context.Context, userId TwitterUserId) ([]*ProfileChange, error) {
+	rows, err := ds.DB.QueryContext(ctx, selectProfileHistory, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+	var changes []*ProfileChange
+	for rows.Next() {
+		var change ProfileChange
+		var oldValue, newValue sql.NullString
+		err = rows.Scan(&change.UserId, &change.Field, &oldValue, &newValue, &change.ChangedAt)
+		if err != nil {
+			return nil, err
+		}
+		change.OldValue, change.NewValue, change.ChangedAt = oldValue.String, newValue.String, change.ChangedAt.UTC()
+		changes = append(changes, &change)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// deleteUser removes the rows referring to a user, given as $1, before the user itself
+var deleteUser = []string{
+	"DELETE FROM user_profile_history WHERE user_id = $1",
+	"DELETE FROM list_members WHERE user_id = $1",
+	"DELETE FROM tweet_entities WHERE tweet_id IN (SELECT id FROM tweets WHERE user_id = $1)",
+	"DELETE FROM tweet_references WHERE tweet_id IN (SELECT id FROM tweets WHERE user_id = $1)",
+	"DELETE FROM tweets WHERE user_id = $1",
+	"DELETE FROM checkpoint WHERE user_id = $1",
+	"DELETE FROM users WHERE id = $1",
+}
+
+func (ds *Database) RemoveUser(ctx context.Context, userId TwitterUserId) error {
+	txn, err := ds.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, statement := range deleteUser {
+		_, err = txn.ExecContext(ctx, statement, userId)
+		if err != nil {
+			rollbackOrLog(txn)
+			return err
+		}
+	}
+	return txn.Commit()
+}
+
+func (ds *Database) SaveTweets(ctx context.Context, userId TwitterUserId, tweets []Tweet) (SaveResult, error) {
+	txn, err := ds.Begin(ctx)
+	if err != nil {
+		return SaveResult{}, err
+	}
+	defer rollbackOrLog(txn)
+	result, err := txn.SaveTweets(ctx, userId, tweets)
+	if err != nil {
+		return SaveResult{}, err
+	}
+	return result, txn.Commit()
+}
+
+func (ds *Database) Begin(ctx context.Context) (Tx, error) {
+	txn, err := ds.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &databaseTx{ds: ds, txn: txn}, nil
+}
+
+type databaseTx struct {
+	ds  *Database
+	txn *sql.Tx
+}
+
+func (tx *databaseTx) SaveTweets(ctx context.Context, userId TwitterUserId, tweets []Tweet) (SaveResult, error) {
+	var result SaveResult
+	tweets, result.Skipped = lastOfEachTweet(tweets)
+	if len(tweets) == 0 {
+		return result, nil
+	}
+	stored, err := tx.storedTweetIds(ctx, tweets)
+	if err != nil {
+		return SaveResult{}, err
+	}
+	stmt, err := tx.txn.PrepareContext(ctx, tx.ds.upsertTweet())
+	if err != nil {
+		return SaveResult{}, err
+	}
+	defer closeStatement(stmt)
+	var referenceRows, entityRows [][]interface{}
+	for _, tweet := range tweets {
+		changed, err := stmt.ExecContext(ctx, tweetRow(userId, tweet)...)
+		if err != nil {
+			return SaveResult{}, err
+		}
+		if stored[tweet.Id] {
+			count, err := changed.RowsAffected()
+			if err != nil {
+				return SaveResult{}, err
+			}
+			if count == 0 {
+				result.Skipped++
+				continue
+			}
+			// the references and entities follow the text, which may have been edited
+			for _, deleteDetails := range []string{deleteTweetReferences, deleteTweetEntities} {
+				if _, err = tx.txn.ExecContext(ctx, deleteDetails, tweet.Id); err != nil {
+					return SaveResult{}, err
+				}
+			}
+			result.Updated++
+		} else {
+			result.Inserted++
+		}
+		for _, reference := range tweet.ReferencedTweets {
+			referenceRows = append(referenceRows, []interface{}{tweet.Id, reference.Type, reference.Id})
+		}
+		entityRows = append(entityRows, entitiesOf(tweet)...)
+	}
+	for _, insert := range []struct {
+		table   string
+		columns []string
+		rows    [][]interface{}
+	}{
+		{"tweet_references", referenceColumns, referenceRows},
+		{"tweet_entities", entityColumns, entityRows},
+	} {
+		err = tx.ds.bulkInsert(ctx, tx.txn, insert.table, insert.columns, insert.rows)
+		if err != nil {
+			return SaveResult{}, err
+		}
+	}
+	return result, nil
+}
+
+// storedTweetIds returns which of the tweets are stored already
+func (tx *databaseTx) storedTweetIds(ctx context.Context, tweets []Tweet) (map[TweetId]bool, error) {
+	placeholders := make([]string, len(tweets))
+	ids := make([]interface{}, len(tweets))
+	for i, tweet := range tweets {
+		placeholders[i] = "$" + strconv.Itoa(i+1)
+		ids[i] = tweet.Id
+	}
+	rows, err := tx.txn.QueryContext(ctx, fmt.Sprintf(selectTweetIds, strings.Join(placeholders, ", ")), ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+	stored := make(map[TweetId]bool)
+	for rows.Next() {
+		var id TweetId
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		stored[id] = true
+	}
+	return stored, rows.Err()
+}
+
+func (tx *databaseTx) UpdateWaterMark(ctx context.Context, userId TwitterUserId, kind WaterMarkType, waterMark string) error {
+	_, err := tx.txn.ExecContext(ctx, upsertCheckpoint, userId, kind, waterMark)
+	return err
+}
+
+func (tx *databaseTx) Commit() error {
+	return tx.txn.Commit()
+}
+
+func (tx *databaseTx) Rollback() error {
+	err := tx.txn.Rollback()
+	if errors.Is(err, sql.ErrTxDone) {
+		return nil
+	}
+	return err
+}
+
+var tweetColumns = []string{"id", "text", "lang", "user_id", "created_at", "author_id", "conversation_id",
+	"in_reply_to_user_id", "possibly_sensitive", "retweet_count", "reply_count", "like_count", "quote_count"}
+var referenceColumns = []string{"tweet_id", "type", "referenced_tweet_id"}
+var entityColumns = []string{"tweet_id", "type", "start_index", "end_index", "value", "entity_id"}
+
+const (
+	entityHashtag = "hashtag"
+	entityCashtag = "cashtag"
+	entityMention = "mention"
+	entityUrl     = "url"
+)
+
+// upsertTweet
+// returns the statement storing a tweet given the values of tweetColumns. A tweet stored already is only updated if
+// any of its values changed, so that the statement reports no affected row otherwise. The user of a tweet never
+// changes.
+func (ds *Database) upsertTweet() string {
+	// SQLite does not know IS DISTINCT FROM, but its IS NOT compares NULL the same way
+	distinct := "IS DISTINCT FROM"
+	if ds.driver != driverPostgres {
+		distinct = "IS NOT"
+	}
+	placeholders := make([]string, len(tweetColumns))
+	var updates, changes []string
+	for i, column := range tweetColumns {
+		placeholders[i] = "$" + strconv.Itoa(i+1)
+		if column == "id" || column == "user_id" {
+			continue
+		}
+		updates = append(updates, fmt.Sprintf("%s = excluded.%s", column, column))
+		changes = append(changes, fmt.Sprintf("tweets.%s %s excluded.%s", column, distinct, column))
+	}
+	return fmt.Sprintf("INSERT INTO tweets (%s) VALUES (%s) ON CONFLICT (id) DO UPDATE SET %s WHERE %s",
+		strings.Join(tweetColumns, ", "), strings.Join(placeholders, ", "), strings.Join(updates, ", "),
+		strings.Join(changes, " OR "))
+}
+
+// tweetRow returns the values of tweetColumns, with NULL for the details twitter did not send
+func tweetRow(userId TwitterUserId, tweet Tweet) []interface{} {
+	var createdAt interface{}
+	if !tweet.CreatedAt.IsZero() {
+		createdAt = tweet.CreatedAt.UTC()
+	}
+	var retweetCount, replyCount, likeCount, quoteCount interface{}
+	if metrics := tweet.PublicMetrics; metrics != nil {
+		retweetCount, replyCount, likeCount, quoteCount = metrics.RetweetCount, metrics.ReplyCount, metrics.LikeCount,
+			metrics.QuoteCount
+	}
+	return []interface{}{tweet.Id, tweet.Text, tweet.Lang, userId, createdAt, nullIfEmpty(tweet.AuthorId),
+		nullIfEmpty(tweet.ConversationId), nullIfEmpty(tweet.InReplyToUserId), tweet.PossiblySensitive, retweetCount,
+		replyCount, likeCount, quoteCount}
+}
+
+// entitiesOf returns the values of entityColumns for each entity of tweet
+func entitiesOf(tweet Tweet) [][]interface{} {
+	entities := tweet.Entities
+	if entities == nil {
+		return nil
+	}
+	var rows [][]interface{}
+	row := func(kind string, entity Entity, value string, id string) {
+		rows = append(rows, []interface{}{tweet.Id, kind, entity.Start, entity.End, value, nullIfEmpty(id)})
+	}
+	for _, hashtag := range entities.Hashtags {
+		row(entityHashtag, hashtag.Entity, hashtag.Tag, "")
+	}
+	for _, cashtag := range entities.Cashtags {
+		row(entityCashtag, cashtag.Entity, cashtag.Tag, "")
+	}
+	for _, mention := range entities.Mentions {
+		row(entityMention, mention.Entity, mention.UserName, mention.Id)
+	}
+	for _, url := range entities.Urls {
+		value := url.ExpandedUrl
+		if len(value) == 0 {
+			value = url.Url
+		}
+		row(entityUrl, url.Entity, value, "")
+	}
+	return rows
+}
+
+func nullIfEmpty(value string) interface{} {
+	if len(value) == 0 {
+		return nil
+	}
+	return value
+}
+
+// bulkInsert adds rows to table within txn. Postgres receives them through COPY.
+func (ds *Database) bulkInsert(ctx context.Context, txn *sql.Tx, table string, columns []string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	var statement string
+	if ds.driver == driverPostgres {
+		statement = pq.CopyIn(table, columns...)
+	} else {
+		placeholders := make([]string, len(columns))
+		for i := range columns {
+			placeholders[i] = "$" + strconv.Itoa(i+1)
+		}
+		statement = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(columns, ", "),
+			strings.Join(placeholders, ", "))
+	}
+	stmt, err := txn.PrepareContext(ctx, statement)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		_, err = stmt.ExecContext(ctx, row...)
+		if err != nil {
+			closeStatement(stmt)
+			return err
+		}
+	}
+	if ds.driver == driverPostgres {
+		// rows given to COPY are only sent once it is executed without arguments
+		_, err = stmt.ExecContext(ctx)
+		if err != nil {
+			closeStatement(stmt)
+			return err
+		}
+	}
+	return stmt.Close()
+}
+
+func (ds *Database) UpdateWaterMark(ctx context.Context, userId TwitterUserId, kind WaterMarkType, waterMark string) error {
+	_, err := ds.DB.ExecContext(ctx, upsertCheckpoint, userId, kind, waterMark)
+	return err
+}
+
+func (ds *Database) GetWaterMark(ctx context.Context, userId TwitterUserId, kind WaterMarkType) (string, error) {
+	return ds.queryString(ctx, selectCheckpoint, userId, kind)
+}
+
+func (ds *Database) GetOldestTweetId(ctx context.Context, userId TwitterUserId) (TweetId, error) {
+	return ds.queryString(ctx, selectOldestTweetId, userId)
+}
+
+func (ds *Database) GetListMembers(ctx context.Context, listId string) ([]*ListMember, error) {
+	rows, err := ds.DB.QueryContext(ctx, selectListMembers, listId)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+	var members []*ListMember
+	for rows.Next() {
+		var member ListMember
+		var leftAt sql.NullTime
+		err = rows.Scan(&member.ListId, &member.UserId, &member.JoinedAt, &leftAt)
+		if err != nil {
+			return nil, err
+		}
+		member.JoinedAt = member.JoinedAt.UTC()
+		if leftAt.Valid {
+			member.LeftAt = leftAt.Time.UTC()
+		}
+		members = append(members, &member)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func (ds *Database) AddListMember(ctx context.Context, listId string, userId TwitterUserId, at time.Time) error {
+	_, err := ds.DB.ExecContext(ctx, upsertListMember, listId, userId, at.UTC())
 	return err
 }
 
-func (ds *Database) GetSinceId(userId TwitterUserId) (TweetId, error) {
-	rows, err := ds.DB.Query(fmt.Sprintf("SELECT watermark FROM checkpoint WHERE user_id='%s' AND type='%s'", userId, tweetWaterMark))
+func (ds *Database) SetListMemberLeft(ctx context.Context, listId string, userId TwitterUserId, at time.Time) error {
+	result, err := ds.DB.ExecContext(ctx, updateListMemberLeft, at.UTC(), listId, userId)
+	if err != nil {
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("user with id '%s' is not a member of list '%s'", userId, listId)
+	}
+	return nil
+}
+
+// queryString returns the string in the first column of the first row, or empty string if there is no row
+func (ds *Database) queryString(ctx context.Context, query string, args ...interface{}) (string, error) {
+	rows, err := ds.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return "", err
 	}
@@ -92,17 +543,19 @@ func (ds *Database) GetSinceId(userId TwitterUserId) (TweetId, error) {
 	if !hasNext {
 		return "", nil
 	}
-	var waterMark string
-	err = rows.Scan(&waterMark)
-	return waterMark, err
+	var value string
+	err = rows.Scan(&value)
+	return value, err
 }
 
 func scanUser(rows *sql.Rows) (*User, error) {
-	var id string
-	var name string
-	var profilePictureUrl string
-	err := rows.Scan(&id, &name, &profilePictureUrl)
-	return &User{Id: id, Name: name, ProfilePictureUrl: profilePictureUrl}, err
+	var user User
+	var profilePictureUrl, displayName, description, location, url sql.NullString
+	err := rows.Scan(&user.Id, &user.Name, &profilePictureUrl, &displayName, &description, &location, &url,
+		&user.Verified, &user.Protected)
+	user.ProfilePictureUrl, user.DisplayName, user.Description = profilePictureUrl.String, displayName.String, description.String
+	user.Location, user.Url = location.String, url.String
+	return &user, err
 }
 
 func closeRows(rows *sql.Rows) {
@@ -112,12 +565,21 @@ func closeRows(rows *sql.Rows) {
 	}
 }
 
-func (ds *Database) Close() error {
-	return ds.DB.Close()
+func closeStatement(stmt *sql.Stmt) {
+	err := stmt.Close()
+	if err != nil {
+		log.Warn().Str(dsLoggerId, dsLoggerId).Err(err).Msg("failed to close statement")
+	}
 }
 
-type User struct {
-	Id                string
-	Name              string
-	ProfilePictureUrl string
+// rollbackOrLog rolls back a Tx or a *sql.Tx, logging a failure as the error that caused the rollback matters more
+func rollbackOrLog(txn interface{ Rollback() error }) {
+	err := txn.Rollback()
+	if err != nil {
+		log.Error().Str(dsLoggerId, dsLoggerId).Err(err).Msg("failed to rollback transaction")
+	}
+}
+
+func (ds *Database) Close() error {
+	return ds.DB.Close()
 }
@@ -0,0 +1,129 @@
+package fetch
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The kinds of failures callers react to. They are matched with errors.Is, the details of those of twitter are in a
+// *TwitterError.
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrUnauthorized is returned when twitter rejects the bearer token
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrForbidden is returned for resources the app may not read, such as the tweets of a protected user
+	ErrForbidden   = errors.New("forbidden")
+	ErrRateLimited = errors.New("rate limited")
+	ErrSuspended   = errors.New("user suspended")
+	// ErrInvalidResponse is returned when the response of twitter cannot be read or decoded
+	ErrInvalidResponse = errors.New("invalid response")
+	// ErrUserNotTracked is returned for a user name that is not in the Store
+	ErrUserNotTracked = errors.New("user not tracked")
+)
+
+// problem types of the v2 api
+const (
+	problemResourceNotFound = "https://api.twitter.com/2/problems/resource-not-found"
+	problemNotAuthorized    = "https://api.twitter.com/2/problems/not-authorized-for-resource"
+	problemUsageCapped      = "https://api.twitter.com/2/problems/usage-capped"
+)
+
+// APIError
+// is an entry of the errors array of the v2 api, or the problem returned with a failed request.
+type APIError struct {
+	Title        string `json:"title"`
+	Detail       string `json:"detail"`
+	Type         string `json:"type"`
+	ResourceType string `json:"resource_type"`
+	ResourceId   string `json:"resource_id"`
+	Parameter    string `json:"parameter"`
+	Value        string `json:"value"`
+	// Message replaces the other fields in the errors of an invalid request
+	Message string `json:"message"`
+}
+
+func (e APIError) Error() string {
+	detail := e.Detail
+	if len(detail) == 0 {
+		detail = e.Message
+	}
+	if len(e.Title) == 0 {
+		return detail
+	}
+	if len(detail) == 0 {
+		return e.Title
+	}
+	return e.Title + ": " + detail
+}
+
+// kind returns the one of the exported errors this error is, or nil
+func (e APIError) kind() error {
+	switch {
+	case strings.Contains(strings.ToLower(e.Detail), "suspended"):
+		return ErrSuspended
+	case e.Type == problemResourceNotFound || e.Title == "Not Found Error":
+		return ErrNotFound
+	case e.Type == problemNotAuthorized || e.Title == "Authorization Error":
+		return ErrForbidden
+	case e.Type == problemUsageCapped:
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// problem is the body of a failed request
+type problem struct {
+	APIError
+	Errors []APIError `json:"errors"`
+}
+
+// TwitterError
+// is a request refused by twitter, either by its status code or by the errors in the response.
+type TwitterError struct {
+	// StatusCode is http.StatusOK if the request succeeded but the errors prevent using the response
+	StatusCode int
+	Url        string
+	Errors     []APIError
+	kind       error
+}
+
+func newTwitterError(statusCode int, url string, apiErrors []APIError) *TwitterError {
+	e := &TwitterError{StatusCode: statusCode, Url: url, Errors: apiErrors}
+	switch statusCode {
+	case http.StatusUnauthorized:
+		e.kind = ErrUnauthorized
+	case http.StatusTooManyRequests:
+		e.kind = ErrRateLimited
+	}
+	// the errors tell a suspended user from one that does not exist, which share status codes
+	for _, apiError := range apiErrors {
+		if e.kind != nil {
+			break
+		}
+		e.kind = apiError.kind()
+	}
+	if e.kind == nil && statusCode == http.StatusForbidden {
+		e.kind = ErrForbidden
+	} else if e.kind == nil && statusCode == http.StatusNotFound {
+		e.kind = ErrNotFound
+	}
+	return e
+}
+
+func (e *TwitterError) Error() string {
+	msg := fmt.Sprintf("twitter returned status code '%d' for url '%s'", e.StatusCode, e.Url)
+	if e.kind != nil {
+		msg = fmt.Sprintf("%s (%s)", msg, e.kind)
+	}
+	for _, apiError := range e.Errors {
+		msg = msg + "; " + apiError.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the kind of the failure, nil if it is none of the exported errors
+func (e *TwitterError) Unwrap() error {
+	return e.kind
+}
@@ -0,0 +1,101 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// statusClient answers every request with statusCode and body
+type statusClient struct {
+	statusCode int
+	body       string
+}
+
+func (c statusClient) Do(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: c.statusCode, Body: ioutil.NopCloser(bytes.NewReader([]byte(c.body)))}, nil
+}
+
+func TestTwitterErrorKinds(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		expected   error
+	}{
+		{"unauthorized", http.StatusUnauthorized,
+			`{"title": "Unauthorized", "type": "about:blank", "status": 401, "detail": "Unauthorized"}`, ErrUnauthorized},
+		{"rate limited", http.StatusTooManyRequests, `{"title": "Too Many Requests"}`, ErrRateLimited},
+		{"not found", http.StatusNotFound, "", ErrNotFound},
+		{"protected", http.StatusForbidden, "", ErrForbidden},
+		{"suspended", http.StatusOK, `{"errors": [{"value": "gone", "detail": "User has been suspended: [gone].",
+			"title": "Forbidden", "resource_type": "user", "parameter": "username", "resource_id": "gone",
+			"type": "https://api.twitter.com/2/problems/resource-not-found"}]}`, ErrSuspended},
+		{"does not exist", http.StatusOK, `{"errors": [{"value": "nobody", "detail": "Could not find user with username: [nobody].",
+			"title": "Not Found Error", "resource_type": "user", "parameter": "username", "resource_id": "nobody",
+			"type": "https://api.twitter.com/2/problems/resource-not-found"}]}`, ErrNotFound},
+		{"undecodable", http.StatusOK, "{", ErrInvalidResponse},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			twitterClient := HttpTwitterClient{Client: statusClient{statusCode: test.statusCode, body: test.body}}
+			_, err := twitterClient.FindUser(context.Background(), "nobody")
+			if !errors.Is(err, test.expected) {
+				t.Errorf("Error = %v; expected %v", err, test.expected)
+			}
+		})
+	}
+}
+
+func TestTwitterErrorDetails(t *testing.T) {
+	body := `{"errors": [{"parameters": {"max_results": ["500"]}, "message": "The max_results query parameter value [500] is not between 5 and 100"}],
+		"title": "Invalid Request", "detail": "One or more parameters to your request was invalid.",
+		"type": "https://api.twitter.com/2/problems/invalid-request"}`
+	twitterClient := HttpTwitterClient{Client: statusClient{statusCode: http.StatusBadRequest, body: body}}
+	_, err := twitterClient.FindUser(context.Background(), "nobody")
+	var twitterError *TwitterError
+	if !errors.As(err, &twitterError) {
+		t.Fatalf("Error = %v; expected *TwitterError", err)
+	}
+	if twitterError.StatusCode != http.StatusBadRequest || len(twitterError.Errors) == 0 ||
+		twitterError.Errors[0].Title != "Invalid Request" {
+		t.Errorf("Error = %+v; expected the status code and the problem", twitterError)
+	}
+	if errors.Unwrap(err) != nil {
+		t.Errorf("kind = %v; expected none", errors.Unwrap(err))
+	}
+}
+
+func TestUnauthorizedStopsRun(t *testing.T) {
+	client := &MockClient{StatusCode: http.StatusUnauthorized}
+	fetcher, store := newTestFetcher(client)
+	for _, name := range []string{"user1", "user2", "user3"} {
+		if err := store.AddUser(context.Background(), &User{Id: "id-" + name, Name: name}); err != nil {
+			t.Fatalf("Error = %v; expected nil", err)
+		}
+	}
+	err := fetcher.GetAllUserTweets(context.Background())
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Error = %v; expected %v", err, ErrUnauthorized)
+	}
+	var failures UserErrors
+	if !errors.As(err, &failures) || len(failures) != 1 {
+		t.Errorf("failures = %v; expected only the first user", failures)
+	}
+	if client.requestNumber != 1 {
+		t.Errorf("requests = %d; expected = 1", client.requestNumber)
+	}
+}
+
+func TestUserNotTracked(t *testing.T) {
+	fetcher := &Fetcher{TwitterClient: HttpTwitterClient{Client: &MockClient{}}, Store: NewMemoryStore()}
+	if err := fetcher.GetUserTweets(context.Background(), "nobody"); !errors.Is(err, ErrUserNotTracked) {
+		t.Errorf("Error = %v; expected %v", err, ErrUserNotTracked)
+	}
+	if err := fetcher.RefreshUsers(context.Background(), "nobody"); !errors.Is(err, ErrUserNotTracked) {
+		t.Errorf("Error = %v; expected %v", err, ErrUserNotTracked)
+	}
+}
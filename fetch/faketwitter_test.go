@@ -0,0 +1,143 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mrnakumar.com/poli/faketwitter"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const fakeBearer = "fake-bearer"
+const fakeUserId = "100"
+const fakeUserName = "poli_user"
+
+// newFakeTwitter
+// starts a fake twitter with a user of count tweets from the last hours, and returns a Fetcher on it.
+func newFakeTwitter(t *testing.T, count int) (*faketwitter.Server, *Fetcher, *MemoryStore) {
+	server := faketwitter.NewServer()
+	t.Cleanup(server.Close)
+	server.Bearer = fakeBearer
+	server.RateLimit = 900
+	server.AddUser(faketwitter.User{Id: fakeUserId, Name: "Poli User", UserName: fakeUserName})
+	server.AddUser(faketwitter.User{Id: "200", Name: "Suspended", UserName: "suspended_user", Suspended: true})
+	addFakeTweets(server, 1000, count)
+	store := NewMemoryStore()
+	fetcher := &Fetcher{
+		TwitterClient: HttpTwitterClient{
+			BaseUrl:    server.URL,
+			Bearer:     fakeBearer,
+			Client:     server.Client(),
+			RateLimits: NewRateLimiter(),
+		},
+		Store: store,
+	}
+	return server, fetcher, store
+}
+
+// addFakeTweets adds count tweets with ids from firstId, one minute apart
+func addFakeTweets(server *faketwitter.Server, firstId int, count int) {
+	start := time.Now().Add(-time.Duration(count) * time.Minute)
+	for i := 0; i < count; i++ {
+		server.AddTweets(fakeUserId, faketwitter.Tweet{
+			Id:        fmt.Sprint(firstId + i),
+			Text:      fmt.Sprintf("tweet %d", i),
+			Lang:      "en",
+			CreatedAt: start.Add(time.Duration(i) * time.Minute).UTC().Truncate(time.Second),
+		})
+	}
+}
+
+func TestFakeTwitterFetchesPagesAndNewTweets(t *testing.T) {
+	server, fetcher, store := newFakeTwitter(t, 150)
+	if err := fetcher.AddUser(context.Background(), fakeUserName); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if err := fetcher.GetUserTweets(context.Background(), fakeUserName); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if len(store.tweets) != 150 {
+		t.Errorf("stored tweets = %d; expected = 150", len(store.tweets))
+	}
+	if requests := server.Requests(faketwitter.EndpointUserTweets); requests != 2 {
+		t.Errorf("requests = %d; expected = 2", requests)
+	}
+	if sinceId, _ := store.GetWaterMark(context.Background(), fakeUserId, tweetWaterMark); sinceId != "1149" {
+		t.Errorf("since id = %s; expected = 1149", sinceId)
+	}
+
+	addFakeTweets(server, 1150, 3)
+	if err := fetcher.GetUserTweets(context.Background(), fakeUserName); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if len(store.tweets) != 153 {
+		t.Errorf("stored tweets = %d; expected = 153", len(store.tweets))
+	}
+	// only the new tweets are read since the last run
+	if requests := server.Requests(faketwitter.EndpointUserTweets); requests != 3 {
+		t.Errorf("requests = %d; expected = 3", requests)
+	}
+	limit, ok := fetcher.TwitterClient.RateLimits.Get(EndpointUserTweets)
+	if !ok || limit.Limit != 900 || limit.Remaining != 897 {
+		t.Errorf("rate limit = %+v; expected 897 of 900 remaining", limit)
+	}
+}
+
+func TestFakeTwitterErrors(t *testing.T) {
+	server, fetcher, _ := newFakeTwitter(t, 5)
+	if err := fetcher.AddUser(context.Background(), "suspended_user"); !errors.Is(err, ErrSuspended) {
+		t.Errorf("Error = %v; expected %v", err, ErrSuspended)
+	}
+	if err := fetcher.AddUser(context.Background(), "nobody"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Error = %v; expected %v", err, ErrNotFound)
+	}
+	if err := fetcher.AddUser(context.Background(), fakeUserName); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	server.FailNext(faketwitter.EndpointUserTweets, http.StatusServiceUnavailable, 1)
+	err := fetcher.GetUserTweets(context.Background(), fakeUserName)
+	var twitterErr *TwitterError
+	if !errors.As(err, &twitterErr) || twitterErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Error = %v; expected status code 503", err)
+	}
+	fetcher.TwitterClient.Bearer = "revoked"
+	if err = fetcher.GetUserTweets(context.Background(), fakeUserName); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Error = %v; expected %v", err, ErrUnauthorized)
+	}
+}
+
+func TestFakeTwitterRateLimit(t *testing.T) {
+	server, fetcher, _ := newFakeTwitter(t, 30)
+	server.RateLimit = 1
+	var waits []time.Duration
+	fetcher.TwitterClient.RateLimits.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return errors.New("not waiting in the test")
+	}
+	if err := fetcher.AddUser(context.Background(), fakeUserName); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if err := fetcher.TwitterClient.RateLimits.acquire(context.Background(), EndpointUserByName); err == nil {
+		t.Errorf("Error = nil; expected the exhausted rate limit to wait")
+	}
+	if len(waits) != 1 || waits[0] <= 0 || waits[0] > server.Window+rateLimitResetMargin {
+		t.Errorf("waits = %v; expected one wait until the reset", waits)
+	}
+}
+
+func TestFakeTwitterAppToken(t *testing.T) {
+	server, fetcher, _ := newFakeTwitter(t, 5)
+	server.ConsumerKey, server.ConsumerSecret = "key", "secret"
+	tokens := NewAppTokenSource("key", "secret", server.Client())
+	tokens.BaseUrl = server.URL
+	fetcher.TwitterClient.Bearer = ""
+	fetcher.TwitterClient.Tokens = tokens
+	if err := fetcher.AddUser(context.Background(), fakeUserName); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if requests := server.Requests(faketwitter.EndpointToken); requests != 1 {
+		t.Errorf("token requests = %d; expected = 1", requests)
+	}
+}
@@ -1,12 +1,12 @@
 package fetch
 
 import (
-	"database/sql"
+	"context"
 	"errors"
 	"fmt"
-	"github.com/lib/pq"
 	"github.com/rs/zerolog/log"
 	"mrnakumar.com/poli/constants"
+	"sync"
 	"time"
 )
 
@@ -14,15 +14,56 @@ const fetcherLoggerId = "fetcher"
 const tweetFetchSize = 100 // maximum allowed
 const tweetWaterMark WaterMarkType = "twitter"
 
+// The pages of a run of GetUserTweets are read newest first, so its since id can only move once the last page is
+// stored. Until then these checkpoint the page to read next and the bounds of the run, so that an interrupted run
+// resumes from there. They are empty when no run is in progress.
+const (
+	tweetNextTokenWaterMark WaterMarkType = "twitter_next_token"
+	tweetNewestWaterMark    WaterMarkType = "twitter_newest"
+	tweetStartTimeWaterMark WaterMarkType = "twitter_start_time"
+)
+
 type WaterMarkType = string
 
 type Fetcher struct {
 	TwitterClient HttpTwitterClient
-	Database      *Database
+	Store         Store
+	// Concurrency is the number of users whose tweets are fetched at the same time. Users are fetched one at a time
+	// if it is 1 or less.
+	Concurrency int
+	// UserTimeout bounds the time spent on the tweets of each user, RunTimeout the time spent on all the users of a
+	// run. There is no bound if they are 0.
+	UserTimeout time.Duration
+	RunTimeout  time.Duration
+	// Lists are the ids of the twitter lists whose members Serve syncs before each run
+	Lists []string
+}
+
+// UserErrors
+// maps the name of each user whose tweets could not be fetched to the failure.
+type UserErrors map[string]error
+
+func (e UserErrors) Error() string {
+	return fmt.Sprintf("failed to get tweets for '%d' users", len(e))
+}
+
+// Is returns whether the failure of any user is target
+func (e UserErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// stopsRun returns whether err would fail the users after the one it happened to as well
+func stopsRun(err error) bool {
+	return errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrRateLimited)
 }
 
-func (f *Fetcher) AddUser(userName string) error {
-	user, err := f.Database.GetUser(userName)
+func (f *Fetcher) AddUser(ctx context.Context, userName string) error {
+	user, err := f.Store.GetUserIgnoringCase(ctx, userName)
 	if err != nil {
 		return err
 	}
@@ -31,17 +72,44 @@ func (f *Fetcher) AddUser(userName string) error {
 		log.Info().Str(constants.LoggerId, fetcherLoggerId).Msgf("user %s already exists", userName)
 		return nil
 	}
-	response, err := f.TwitterClient.FindUser(userName)
+	response, err := f.TwitterClient.FindUser(ctx, userName)
+	if err != nil {
+		return fmt.Errorf("failed to find user '%s': %w", userName, err)
+	}
+	return f.trackUser(ctx, response.Data)
+}
+
+// trackUser stores the user found on twitter as data, so that their tweets are fetched from then on
+func (f *Fetcher) trackUser(ctx context.Context, data UserData) error {
+	err := f.Store.AddUser(ctx, newUser(data))
 	if err != nil {
 		return err
 	}
-	data := response.Data
-	_, err = f.Database.DB.Exec(fmt.Sprintf("INSERT INTO users values ('%s', '%s', '%s')", data.Id, data.UserName, data.ProfileImageUrl))
-	return err
+	log.Info().Str(constants.LoggerId, fetcherLoggerId).Msgf("tracking user '%s'", data.UserName)
+	return nil
 }
 
-func (f *Fetcher) GetAllUserTweets() error {
-	users, err := f.Database.GetAllUsers()
+func (f *Fetcher) GetAllUserTweets(ctx context.Context) error {
+	return f.getAllUserTweets(ctx, nil)
+}
+
+// getAllUserTweets stops starting on new users once stop is closed. A nil stop never does.
+func (f *Fetcher) getAllUserTweets(ctx context.Context, stop <-chan struct{}) error {
+	return f.forAllUsers(ctx, stop, func(ctx context.Context, user *User) error {
+		return f.GetUserTweets(ctx, user.Name)
+	})
+}
+
+// forAllUsers
+// calls getTweets for every user and logs the outcome. Once ctx is done, including when f.RunTimeout passes, the
+// calls in progress are cancelled and the users not yet started are skipped.
+func (f *Fetcher) forAllUsers(ctx context.Context, stop <-chan struct{}, getTweets func(ctx context.Context, user *User) error) error {
+	if f.RunTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.RunTimeout)
+		defer cancel()
+	}
+	users, err := f.Store.GetAllUsers(ctx)
 	if err != nil {
 		log.Error().Str(constants.LoggerId, fetcherLoggerId).Err(err).Msg("failed to get all users from DB")
 		return errors.New("could not get users from DB")
@@ -49,98 +117,230 @@ func (f *Fetcher) GetAllUserTweets() error {
 		log.Info().Str(constants.LoggerId, fetcherLoggerId).Err(err).Msg("no users in DB")
 		return errors.New("no users to get tweets for")
 	} else {
-		var successCount = 0
-		for _, user := range users {
-			err = f.GetUserTweets(user.Name)
-			if err == nil {
-				successCount++
-			} else {
-				log.Error().Str(constants.LoggerId, fetcherLoggerId).Err(err).Msgf("error in getting tweets for user '%s'", user.Name)
+		failures, skipped := f.getTweetsOfUsers(ctx, users, stop, getTweets)
+		successCount := len(users) - len(failures) - skipped
+		log.Info().Str(constants.LoggerId, fetcherLoggerId).Msgf("success in fetching tweets for '%d' users out of a total of '%d'", successCount, len(users))
+		if skipped > 0 {
+			log.Info().Str(constants.LoggerId, fetcherLoggerId).Msgf("skipped '%d' users as the run was stopped", skipped)
+		}
+		if ctx.Err() != nil {
+			log.Warn().Str(constants.LoggerId, fetcherLoggerId).Err(ctx.Err()).Msg("run was cancelled")
+		}
+		f.logRateLimit(EndpointUserTweets)
+		if len(failures) > 0 {
+			return failures
+		}
+		return ctx.Err()
+	}
+
+}
+
+// getTweetsOfUsers
+// calls getTweets for users on a pool of f.Concurrency workers and returns the failures. Once stop is closed or ctx is
+// done the users not yet started are skipped and counted, while those in progress are completed or cancelled with
+// ctx. Each call is given f.UserTimeout.
+func (f *Fetcher) getTweetsOfUsers(ctx context.Context, users []*User, stop <-chan struct{}, getTweets func(ctx context.Context, user *User) error) (UserErrors, int) {
+	workers := f.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(users) {
+		workers = len(users)
+	}
+	// a failure that would repeat for every user cancels the run
+	ctx, cancelRun := context.WithCancel(ctx)
+	defer cancelRun()
+	pending := make(chan *User)
+	failures := make(UserErrors)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for user := range pending {
+				err := f.withUserTimeout(ctx, func(ctx context.Context) error {
+					return getTweets(ctx, user)
+				})
+				if err != nil {
+					logUserFailure(user, err)
+					if stopsRun(err) {
+						cancelRun()
+					}
+					mu.Lock()
+					failures[user.Name] = err
+					mu.Unlock()
+				}
 			}
+		}()
+	}
+	skipped := 0
+feed:
+	for i, user := range users {
+		select {
+		case <-stop:
+			skipped = len(users) - i
+			break feed
+		case <-ctx.Done():
+			skipped = len(users) - i
+			break feed
+		default:
 		}
-		log.Info().Str(constants.LoggerId, fetcherLoggerId).Err(err).Msgf("success in fetching tweets for '%d' users out of a total of '%d'", successCount, len(users))
-		if successCount == len(users) {
-			return nil
-		} else {
-			return fmt.Errorf("failed to get tweets for '%d' users", len(users)-successCount)
+		select {
+		case pending <- user:
+		case <-stop:
+			skipped = len(users) - i
+			break feed
+		case <-ctx.Done():
+			skipped = len(users) - i
+			break feed
 		}
 	}
+	close(pending)
+	wg.Wait()
+	return failures, skipped
+}
 
+func logUserFailure(user *User, err error) {
+	switch {
+	case errors.Is(err, ErrSuspended):
+		log.Warn().Str(constants.LoggerId, fetcherLoggerId).Err(err).Msgf("user '%s' is suspended", user.Name)
+	case errors.Is(err, ErrNotFound):
+		log.Warn().Str(constants.LoggerId, fetcherLoggerId).Err(err).Msgf("user '%s' no longer exists", user.Name)
+	case errors.Is(err, ErrForbidden):
+		log.Warn().Str(constants.LoggerId, fetcherLoggerId).Err(err).Msgf("tweets of user '%s' are protected", user.Name)
+	case stopsRun(err):
+		log.Error().Str(constants.LoggerId, fetcherLoggerId).Err(err).Msgf("stopping the run after getting tweets for user '%s' failed", user.Name)
+	default:
+		log.Error().Str(constants.LoggerId, fetcherLoggerId).Err(err).Msgf("error in getting tweets for user '%s'", user.Name)
+	}
+}
+
+// withUserTimeout calls fn with ctx bounded by f.UserTimeout
+func (f *Fetcher) withUserTimeout(ctx context.Context, fn func(ctx context.Context) error) error {
+	if f.UserTimeout <= 0 {
+		return fn(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, f.UserTimeout)
+	defer cancel()
+	return fn(ctx)
 }
-func (f *Fetcher) GetUserTweets(userName string) error {
+
+func (f *Fetcher) GetUserTweets(ctx context.Context, userName string) error {
 	logFailure := func(failure string, err error) {
 		failureMsg := fmt.Sprintf("failed in '%s' for userName '%s'", failure, userName)
 		log.Error().Str(constants.LoggerId, fetcherLoggerId).Err(err).Msg(failureMsg)
 	}
-	rollbackOrLogOnError := func(txn *sql.Tx) {
-		err2 := txn.Rollback()
-		if err2 != nil {
-			log.Error().Str(constants.LoggerId, fetcherLoggerId).Err(err2)
-		}
-	}
-	user, err := f.Database.GetUser(userName)
+	user, err := f.findUser(ctx, userName)
 	if err != nil {
 		logFailure("getting user", err)
 		return err
 	}
-	if user == nil {
-		return fmt.Errorf("not found user '%s'", userName)
+	stored := make(map[WaterMarkType]string)
+	for _, kind := range []WaterMarkType{tweetWaterMark, tweetNextTokenWaterMark, tweetNewestWaterMark, tweetStartTimeWaterMark} {
+		stored[kind], err = f.Store.GetWaterMark(ctx, user.Id, kind)
+		if err != nil {
+			return err
+		}
+	}
+	sinceId, nextToken := stored[tweetWaterMark], stored[tweetNextTokenWaterMark]
+	newestId, startTime := stored[tweetNewestWaterMark], stored[tweetStartTimeWaterMark]
+	if len(nextToken) > 0 {
+		log.Info().Str(constants.LoggerId, fetcherLoggerId).Msgf("resuming interrupted fetch of tweets for userName '%s'", userName)
+	} else {
+		newestId, startTime = "", ""
+		if len(sinceId) == 0 {
+			location, _ := time.LoadLocation("UTC")
+			// Get tweets for past two days
+			startTime = time.Now().In(location).AddDate(0, 0, -2).Format(time.RFC3339)
+		}
 	}
-	var startTime string
-	sinceId, err := f.Database.GetSinceId(user.Id)
+	query := TweetsQuery{SinceId: sinceId, StartTime: startTime}
+	err = f.TwitterClient.QueryTweetPages(ctx, user.Id, tweetFetchSize, query, nextToken, func(page *TweetsResponse) error {
+		if len(page.Tweets) == 0 && len(newestId) == 0 {
+			// nothing new and no run to complete
+			return nil
+		}
+		if len(newestId) == 0 {
+			newestId = newestTweetId(page)
+		}
+		waterMarks := map[WaterMarkType]string{
+			tweetNextTokenWaterMark: page.Meta.NextToken,
+			tweetNewestWaterMark:    newestId,
+			tweetStartTimeWaterMark: startTime,
+		}
+		if len(page.Tweets) == 0 || len(page.Meta.NextToken) == 0 {
+			// the last page, so the run is complete
+			waterMarks[tweetNextTokenWaterMark], waterMarks[tweetNewestWaterMark], waterMarks[tweetStartTimeWaterMark] = "", "", ""
+			if len(newestId) > 0 {
+				waterMarks[tweetWaterMark] = newestId
+			}
+		}
+		return f.saveTweets(ctx, user, page.Tweets, waterMarks)
+	})
 	if err != nil {
+		logFailure("getting and saving tweets", err)
 		return err
 	}
-	if len(sinceId) == 0 {
-		location, _ := time.LoadLocation("UTC")
-		// Get tweets for past two days
-		startTime = time.Now().In(location).AddDate(0, 0, -2).Format(time.RFC3339)
+	return nil
+}
+
+// saveTweets
+// stores tweets of user and moves the watermarks in a single transaction, so that no watermark is ever past tweets
+// that were not stored.
+func (f *Fetcher) saveTweets(ctx context.Context, user *User, tweets []Tweet, waterMarks map[WaterMarkType]string) error {
+	txn, err := f.Store.Begin(ctx)
+	if err != nil {
+		return err
 	}
-	tweetsResponse, err := f.TwitterClient.GetTweets(user.Id, tweetFetchSize, sinceId, startTime)
+	defer rollbackOrLog(txn)
+	result, err := txn.SaveTweets(ctx, user.Id, tweets)
 	if err != nil {
-		logFailure("getting tweets", err)
 		return err
 	}
-
-	if len(tweetsResponse.Tweets) > 0 {
-		txn, err := f.Database.DB.Begin()
+	for kind, waterMark := range waterMarks {
+		err = txn.UpdateWaterMark(ctx, user.Id, kind, waterMark)
 		if err != nil {
-			logFailure("saving tweets to datastore", err)
-			return err
-		}
-		stmt, err := txn.Prepare(pq.CopyIn("tweets", "id", "text", "lang", "user_id"))
-		if err != nil {
-			logFailure("saving tweets to datastore", err)
-			return err
+			return fmt.Errorf("failed to checkpoint '%s': %w", kind, err)
 		}
+	}
+	err = txn.Commit()
+	if err != nil {
+		return err
+	}
+	log.Info().Str(constants.LoggerId, fetcherLoggerId).Msgf("saved tweets of user '%s': '%d' inserted, '%d' updated, '%d' skipped",
+		user.Name, result.Inserted, result.Updated, result.Skipped)
+	return nil
+}
 
-		for _, tweetsResponse := range tweetsResponse.Tweets {
-			_, err = stmt.Exec(tweetsResponse.Id, tweetsResponse.Text, tweetsResponse.Lang, user.Id)
-			if err != nil {
-				logFailure("loop: saving tweets to datastore", err)
-				rollbackOrLogOnError(txn)
-				return err
-			}
-		}
-		_, err = stmt.Exec()
-		if err != nil {
-			logFailure("statement execute: saving tweets to datastore", err)
-			return err
-		}
+// logRateLimit logs the remaining requests to endpoint so that runs can be planned around it
+func (f *Fetcher) logRateLimit(endpoint string) {
+	if f.TwitterClient.Credentials != nil {
+		f.logCredentialUsage(endpoint)
+		return
+	}
+	if f.TwitterClient.RateLimits == nil {
+		return
+	}
+	limit, ok := f.TwitterClient.RateLimits.Get(endpoint)
+	if ok {
+		log.Info().Str(constants.LoggerId, fetcherLoggerId).Msgf("'%d' of '%d' requests remain for '%s' until '%s'",
+			limit.Remaining, limit.Limit, endpoint, limit.Reset.UTC().Format(time.RFC3339))
+	}
+}
 
-		err = f.Database.UpdateSinceId(user.Id, tweetWaterMark, tweetsResponse.Meta.NewestId)
-		if err != nil {
-			logFailure("checkpointing last read tweet id to datastore", err)
-			rollbackOrLogOnError(txn)
-			return err
+// logCredentialUsage logs the requests sent to endpoint with each credential of the pool and the requests that remain
+func (f *Fetcher) logCredentialUsage(endpoint string) {
+	for _, usage := range f.TwitterClient.Credentials.Usage() {
+		event := log.Info().Str(constants.LoggerId, fetcherLoggerId).
+			Str("credential", usage.Name).
+			Int("requests", usage.Requests[endpoint]).
+			Int("rate_limited", usage.RateLimited).
+			Bool("revoked", usage.Revoked)
+		if limit, ok := usage.RateLimits[endpoint]; ok {
+			event = event.Int("remaining", limit.Remaining).Int("limit", limit.Limit).
+				Str("reset", limit.Reset.UTC().Format(time.RFC3339))
 		}
-		err = stmt.Close()
-		if err != nil {
-			logFailure("statement close: saving tweets to datastore", err)
-			rollbackOrLogOnError(txn)
-			return err
-		}
-		return txn.Commit()
+		event.Msgf("credential usage for '%s'", endpoint)
 	}
-	return nil
 }
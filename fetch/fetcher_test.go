@@ -0,0 +1,320 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestFetcher(client HttpClient) (*Fetcher, *MemoryStore) {
+	store := GetDb("", "", "", "", "", true).(*MemoryStore)
+	fetcher := &Fetcher{
+		TwitterClient: HttpTwitterClient{Bearer: "", Client: client},
+		Store:         store,
+	}
+	return fetcher, store
+}
+
+func TestAddUser(t *testing.T) {
+	fetcher, store := newTestFetcher(&MockClient{})
+	err := fetcher.AddUser(context.Background(), userName)
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	// adding again is a no-op
+	err = fetcher.AddUser(context.Background(), userName)
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	users, _ := store.GetAllUsers(context.Background())
+	if len(users) != 1 {
+		t.Fatalf("users = %d; expected = 1", len(users))
+	}
+	if users[0].Id != userId || users[0].Name != userName {
+		t.Errorf("user = %+v; expected id '%s' and name '%s'", users[0], userId, userName)
+	}
+}
+
+func TestAddUserDoesNotExist(t *testing.T) {
+	fetcher, store := newTestFetcher(&MockClient{})
+	err := fetcher.AddUser(context.Background(), "not_a_user")
+	if err == nil {
+		t.Error("expected error; found none")
+	}
+	users, _ := store.GetAllUsers(context.Background())
+	if len(users) != 0 {
+		t.Errorf("users = %d; expected = 0", len(users))
+	}
+}
+
+func TestGetUserTweets(t *testing.T) {
+	fetcher, store := newTestFetcher(&MockClient{})
+	if err := fetcher.AddUser(context.Background(), userName); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	err := fetcher.GetUserTweets(context.Background(), userName)
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if len(store.tweets) != 10 {
+		t.Errorf("stored tweets = %d; expected = 10", len(store.tweets))
+	}
+	sinceId, _ := store.GetWaterMark(context.Background(), userId, tweetWaterMark)
+	if sinceId != "1301573587187331075" {
+		t.Errorf("since id = %s; expected = '1301573587187331075'", sinceId)
+	}
+}
+
+func TestGetUserTweetsClientErrorKeepsCheckpoint(t *testing.T) {
+	fetcher, store := newTestFetcher(&MockClient{ReturnError: true})
+	if err := fetcher.AddUser(context.Background(), userName); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	_ = store.UpdateWaterMark(context.Background(), userId, tweetWaterMark, sinceTweetId)
+	err := fetcher.GetUserTweets(context.Background(), userName)
+	if err == nil {
+		t.Error("expected error to be present")
+	}
+	if len(store.tweets) != 0 {
+		t.Errorf("stored tweets = %d; expected = 0", len(store.tweets))
+	}
+	sinceId, _ := store.GetWaterMark(context.Background(), userId, tweetWaterMark)
+	if sinceId != sinceTweetId {
+		t.Errorf("since id = %s; expected = '%s'", sinceId, sinceTweetId)
+	}
+}
+
+func TestMemoryStoreUpsertsTweets(t *testing.T) {
+	store := NewMemoryStore()
+	if err := store.AddUser(context.Background(), &User{Id: userId, Name: userName}); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	tweets := []Tweet{{Id: "1", Text: "one", Lang: "en"}, {Id: "2", Text: "two", Lang: "en"}}
+	if _, err := store.SaveTweets(context.Background(), userId, tweets); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	result, err := store.SaveTweets(context.Background(), userId, []Tweet{{Id: "3", Text: "three", Lang: "en"}, {Id: "2", Text: "two", Lang: "en"},
+		{Id: "1", Text: "one edited", Lang: "en"}, {Id: "3", Text: "three", Lang: "en"}})
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	expected := SaveResult{Inserted: 1, Updated: 1, Skipped: 2}
+	if result != expected {
+		t.Errorf("result = %+v; expected = %+v", result, expected)
+	}
+	if len(store.tweets) != 3 {
+		t.Errorf("stored tweets = %d; expected = 3", len(store.tweets))
+	}
+	if text := store.tweets["1"].Text; text != "one edited" {
+		t.Errorf("text = '%s'; expected = 'one edited'", text)
+	}
+}
+
+func TestGetUserTweetsAgainIsIdempotent(t *testing.T) {
+	fetcher, store := newTestFetcher(&MockClient{})
+	if err := fetcher.AddUser(context.Background(), userName); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	for i := 0; i < 2; i++ {
+		// no checkpoint, as after a crash that lost it, so the same window is read again
+		delete(store.checkpoints, checkpointKey{userId: userId, kind: tweetWaterMark})
+		fetcher.TwitterClient.Client = &MockClient{}
+		if err := fetcher.GetUserTweets(context.Background(), userName); err != nil {
+			t.Fatalf("Error = %v; expected nil", err)
+		}
+	}
+	if len(store.tweets) != 10 {
+		t.Errorf("stored tweets = %d; expected = 10", len(store.tweets))
+	}
+}
+
+// usersClient finds any user, giving it the id 'id-<name>', and serves one page of two tweets for each user id.
+// It is safe for concurrent use.
+type usersClient struct {
+	failUserId string
+	// onTweetsRequest is called before serving tweets if not nil
+	onTweetsRequest func()
+	mu              sync.Mutex
+	inFlight        int
+	maxInFlight     int
+}
+
+func (c *usersClient) Do(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	c.inFlight++
+	if c.inFlight > c.maxInFlight {
+		c.maxInFlight = c.inFlight
+	}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.inFlight--
+		c.mu.Unlock()
+	}()
+	// give other workers the time to start
+	time.Sleep(5 * time.Millisecond)
+
+	path := req.URL.Path
+	var body string
+	if strings.HasPrefix(path, "/2/users/by/username/") {
+		name := strings.TrimPrefix(path, "/2/users/by/username/")
+		body = fmt.Sprintf(`{"data": {"id": "id-%s", "username": "%s"}}`, name, name)
+	} else {
+		if c.onTweetsRequest != nil {
+			c.onTweetsRequest()
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/2/users/"), "/tweets")
+		if id == c.failUserId {
+			return nil, errors.New("network error")
+		}
+		body = fmt.Sprintf(`{"data": [{"id": "%[1]s-2", "text": "two", "lang": "en"}, {"id": "%[1]s-1", "text": "one", "lang": "en"}],
+			"meta": {"newest_id": "%[1]s-2", "result_count": 2}}`, id)
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader([]byte(body)))}, nil
+}
+
+func TestGetAllUserTweetsConcurrently(t *testing.T) {
+	client := &usersClient{failUserId: "id-user3"}
+	fetcher, store := newTestFetcher(client)
+	fetcher.Concurrency = 4
+	const userCount = 10
+	for i := 0; i < userCount; i++ {
+		if err := fetcher.AddUser(context.Background(), fmt.Sprintf("user%d", i)); err != nil {
+			t.Fatalf("Error = %v; expected nil", err)
+		}
+	}
+	err := fetcher.GetAllUserTweets(context.Background())
+	var failures UserErrors
+	if !errors.As(err, &failures) {
+		t.Fatalf("Error = %v; expected UserErrors", err)
+	}
+	if len(failures) != 1 || failures["user3"] == nil {
+		t.Errorf("failures = %v; expected only 'user3'", failures)
+	}
+	if len(store.tweets) != 2*(userCount-1) {
+		t.Errorf("stored tweets = %d; expected = %d", len(store.tweets), 2*(userCount-1))
+	}
+	if sinceId, _ := store.GetWaterMark(context.Background(), "id-user7", tweetWaterMark); sinceId != "id-user7-2" {
+		t.Errorf("since id = '%s'; expected = 'id-user7-2'", sinceId)
+	}
+	if client.maxInFlight > fetcher.Concurrency || client.maxInFlight < 2 {
+		t.Errorf("concurrent requests = %d; expected between 2 and %d", client.maxInFlight, fetcher.Concurrency)
+	}
+}
+
+// pagesClient serves three pages of tweets, following the pagination tokens, and fails the page of failToken
+type pagesClient struct {
+	failToken string
+	urls      []string
+}
+
+func (c *pagesClient) Do(req *http.Request) (*http.Response, error) {
+	c.urls = append(c.urls, req.URL.String())
+	token := req.URL.Query().Get("pagination_token")
+	if token == c.failToken {
+		return nil, errors.New("network error")
+	}
+	pages := map[string]string{
+		"": `{"data": [{"id": "30", "text": "thirty", "lang": "en"}, {"id": "29", "text": "twenty nine", "lang": "en"}],
+			"meta": {"newest_id": "30", "oldest_id": "29", "next_token": "page2", "result_count": 2}}`,
+		"page2": `{"data": [{"id": "28", "text": "twenty eight", "lang": "en"}, {"id": "27", "text": "twenty seven", "lang": "en"}],
+			"meta": {"newest_id": "28", "oldest_id": "27", "next_token": "page3", "result_count": 2}}`,
+		"page3": `{"data": [{"id": "26", "text": "twenty six", "lang": "en"}],
+			"meta": {"newest_id": "26", "oldest_id": "26", "result_count": 1}}`,
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader([]byte(pages[token])))}, nil
+}
+
+func TestGetUserTweetsResumesFromNextToken(t *testing.T) {
+	client := &pagesClient{failToken: "page3"}
+	fetcher, store := newTestFetcher(client)
+	if err := store.AddUser(context.Background(), &User{Id: userId, Name: userName}); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if err := fetcher.GetUserTweets(context.Background(), userName); err == nil {
+		t.Fatal("expected error to be present")
+	}
+	// the pages read before the failure are kept, but the since id waits for the run to complete
+	if len(store.tweets) != 4 {
+		t.Errorf("stored tweets = %d; expected = 4", len(store.tweets))
+	}
+	if sinceId, _ := store.GetWaterMark(context.Background(), userId, tweetWaterMark); sinceId != "" {
+		t.Errorf("since id = '%s'; expected none", sinceId)
+	}
+	if nextToken, _ := store.GetWaterMark(context.Background(), userId, tweetNextTokenWaterMark); nextToken != "page3" {
+		t.Errorf("next token = '%s'; expected = 'page3'", nextToken)
+	}
+	startTime, _ := store.GetWaterMark(context.Background(), userId, tweetStartTimeWaterMark)
+
+	client.failToken = "none"
+	client.urls = nil
+	if err := fetcher.GetUserTweets(context.Background(), userName); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if len(client.urls) != 1 || !strings.Contains(client.urls[0], "pagination_token=page3") ||
+		!strings.Contains(client.urls[0], "start_time="+startTime) {
+		t.Errorf("urls = %v; expected only the page of 'page3' since '%s'", client.urls, startTime)
+	}
+	if len(store.tweets) != 5 {
+		t.Errorf("stored tweets = %d; expected = 5", len(store.tweets))
+	}
+	if sinceId, _ := store.GetWaterMark(context.Background(), userId, tweetWaterMark); sinceId != "30" {
+		t.Errorf("since id = '%s'; expected = '30'", sinceId)
+	}
+	if nextToken, _ := store.GetWaterMark(context.Background(), userId, tweetNextTokenWaterMark); nextToken != "" {
+		t.Errorf("next token = '%s'; expected none", nextToken)
+	}
+}
+
+// blockingClient answers no request until it is cancelled
+type blockingClient struct{}
+
+func (c blockingClient) Do(req *http.Request) (*http.Response, error) {
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func TestUserTimeoutCancelsRequests(t *testing.T) {
+	fetcher, store := newTestFetcher(blockingClient{})
+	fetcher.Concurrency = 2
+	fetcher.UserTimeout = 20 * time.Millisecond
+	for _, name := range []string{"user1", "user2"} {
+		if err := store.AddUser(context.Background(), &User{Id: "id-" + name, Name: name}); err != nil {
+			t.Fatalf("Error = %v; expected nil", err)
+		}
+	}
+	err := fetcher.GetAllUserTweets(context.Background())
+	var failures UserErrors
+	if !errors.As(err, &failures) {
+		t.Fatalf("Error = %v; expected UserErrors", err)
+	}
+	for _, name := range []string{"user1", "user2"} {
+		if !errors.Is(failures[name], context.DeadlineExceeded) {
+			t.Errorf("Error of '%s' = %v; expected %v", name, failures[name], context.DeadlineExceeded)
+		}
+	}
+}
+
+func TestCancelledRunSkipsUsers(t *testing.T) {
+	client := &usersClient{}
+	fetcher, store := newTestFetcher(client)
+	if err := store.AddUser(context.Background(), &User{Id: "id-user1", Name: "user1"}); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := fetcher.GetAllUserTweets(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Error = %v; expected %v", err, context.Canceled)
+	}
+	if client.maxInFlight != 0 {
+		t.Errorf("requests = %d; expected none", client.maxInFlight)
+	}
+}
@@ -0,0 +1,112 @@
+package fetch
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"mrnakumar.com/poli/constants"
+	"regexp"
+	"strings"
+)
+
+// userNamePattern is a name twitter can have, a request for any other name is refused as a whole
+var userNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,15}$`)
+
+// ImportResult
+// tells what became of each of the user names of an import.
+type ImportResult struct {
+	Added          []string
+	AlreadyTracked []string
+	NotFound       []string
+	Suspended      []string
+	// Invalid names cannot be those of twitter users
+	Invalid []string
+}
+
+// ImportUsers
+// adds the users with userNames that are not tracked yet. They are looked up MaxUsersPerLookup at a time, so that
+// hundreds of users take a few requests. A leading '@' is ignored and each name is imported once whatever its case.
+func (f *Fetcher) ImportUsers(ctx context.Context, userNames []string) (*ImportResult, error) {
+	tracked, err := f.Store.GetAllUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	trackedNames := make(map[string]bool, len(tracked))
+	trackedIds := make(map[TwitterUserId]bool, len(tracked))
+	for _, user := range tracked {
+		trackedNames[strings.ToLower(user.Name)] = true
+		trackedIds[user.Id] = true
+	}
+	result := &ImportResult{}
+	seen := make(map[string]bool, len(userNames))
+	var pending []string
+	for _, userName := range userNames {
+		userName = strings.TrimPrefix(strings.TrimSpace(userName), "@")
+		key := strings.ToLower(userName)
+		if len(userName) == 0 || seen[key] {
+			continue
+		}
+		seen[key] = true
+		switch {
+		case !userNamePattern.MatchString(userName):
+			result.Invalid = append(result.Invalid, userName)
+		case trackedNames[key]:
+			result.AlreadyTracked = append(result.AlreadyTracked, userName)
+		default:
+			pending = append(pending, userName)
+		}
+	}
+	for start := 0; start < len(pending); start += MaxUsersPerLookup {
+		end := start + MaxUsersPerLookup
+		if end > len(pending) {
+			end = len(pending)
+		}
+		err = f.importBatch(ctx, pending[start:end], trackedIds, result)
+		if err != nil {
+			return result, err
+		}
+	}
+	log.Info().Str(constants.LoggerId, fetcherLoggerId).Msgf("imported users: '%d' added, '%d' already tracked, "+
+		"'%d' not found, '%d' suspended, '%d' invalid", len(result.Added), len(result.AlreadyTracked),
+		len(result.NotFound), len(result.Suspended), len(result.Invalid))
+	return result, nil
+}
+
+func (f *Fetcher) importBatch(ctx context.Context, userNames []string, trackedIds map[TwitterUserId]bool, result *ImportResult) error {
+	response, err := f.TwitterClient.FindUsers(ctx, userNames)
+	if err != nil {
+		return err
+	}
+	found := make(map[string]bool, len(response.Data))
+	for _, data := range response.Data {
+		found[strings.ToLower(data.UserName)] = true
+		if trackedIds[data.Id] {
+			// tracked under the name the user had before
+			result.AlreadyTracked = append(result.AlreadyTracked, data.UserName)
+			continue
+		}
+		err = f.trackUser(ctx, data)
+		if err != nil {
+			return err
+		}
+		trackedIds[data.Id] = true
+		result.Added = append(result.Added, data.UserName)
+	}
+	suspended := make(map[string]bool)
+	for _, apiError := range response.Errors {
+		if apiError.kind() == ErrSuspended {
+			suspended[strings.ToLower(apiError.Value)] = true
+		}
+	}
+	// the errors name the users by the value asked for, and the users missing from both are not found either
+	for _, userName := range userNames {
+		key := strings.ToLower(userName)
+		switch {
+		case found[key]:
+		case suspended[key]:
+			result.Suspended = append(result.Suspended, userName)
+		default:
+			result.NotFound = append(result.NotFound, userName)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"mrnakumar.com/poli/faketwitter"
+	"reflect"
+	"testing"
+)
+
+func TestImportUsers(t *testing.T) {
+	server, fetcher, store := newFakeTwitter(t, 0)
+	if err := fetcher.AddUser(context.Background(), fakeUserName); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	var userNames []string
+	for i := 0; i < 150; i++ {
+		userName := fmt.Sprintf("legislator_%d", i)
+		server.AddUser(faketwitter.User{Id: fmt.Sprint(1000 + i), Name: userName, UserName: userName})
+		userNames = append(userNames, userName)
+	}
+	userNames = append(userNames, fakeUserName, "@LEGISLATOR_0", "suspended_user", "missing_user", "not a name", "")
+
+	result, err := fetcher.ImportUsers(context.Background(), userNames)
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if len(result.Added) != 150 {
+		t.Errorf("added = %d; expected = 150", len(result.Added))
+	}
+	expected := ImportResult{
+		Added:          result.Added,
+		AlreadyTracked: []string{fakeUserName},
+		NotFound:       []string{"missing_user"},
+		Suspended:      []string{"suspended_user"},
+		Invalid:        []string{"not a name"},
+	}
+	if !reflect.DeepEqual(*result, expected) {
+		t.Errorf("result = %+v; expected = %+v", *result, expected)
+	}
+	if requests := server.Requests(faketwitter.EndpointUsersByName); requests != 2 {
+		t.Errorf("requests = %d; expected = 2", requests)
+	}
+	if users, _ := store.GetAllUsers(context.Background()); len(users) != 151 {
+		t.Errorf("users = %d; expected = 151", len(users))
+	}
+
+	// importing again adds nobody
+	result, err = fetcher.ImportUsers(context.Background(), userNames[:150])
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if len(result.Added) != 0 || len(result.AlreadyTracked) != 150 {
+		t.Errorf("added, already tracked = %d, %d; expected = 0, 150", len(result.Added), len(result.AlreadyTracked))
+	}
+}
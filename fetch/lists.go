@@ -0,0 +1,108 @@
+package fetch
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"mrnakumar.com/poli/constants"
+	"time"
+)
+
+// ListSyncResult
+// tells what a sync of a twitter list changed. The users are by their current name on twitter, or by the name they
+// are tracked under for those who left.
+type ListSyncResult struct {
+	// Added are the members who were not tracked before
+	Added []string
+	// Joined are the members who were tracked already and are new to the list
+	Joined []string
+	// Left are the members who are no longer on the list. They are still tracked.
+	Left []string
+}
+
+// SyncList
+// tracks every member of the twitter list with listId, adding them like AddUser does, and records who joined and who
+// left the list since the last sync. The members left are only flagged after all the pages of the list were read, so
+// a failed sync leaves the list as it was.
+func (f *Fetcher) SyncList(ctx context.Context, listId string) (*ListSyncResult, error) {
+	var members []UserData
+	for paginationToken := ""; ; {
+		page, err := f.TwitterClient.GetListMembers(ctx, listId, paginationToken)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, page.Data...)
+		if len(page.Meta.NextToken) == 0 {
+			break
+		}
+		paginationToken = page.Meta.NextToken
+	}
+	tracked, err := f.Store.GetAllUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	trackedById := make(map[TwitterUserId]*User, len(tracked))
+	for _, user := range tracked {
+		trackedById[user.Id] = user
+	}
+	stored, err := f.Store.GetListMembers(ctx, listId)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[TwitterUserId]bool, len(stored))
+	for _, member := range stored {
+		current[member.UserId] = member.LeftAt.IsZero()
+	}
+	now := time.Now().UTC()
+	result := &ListSyncResult{}
+	onList := make(map[TwitterUserId]bool, len(members))
+	for _, data := range members {
+		if onList[data.Id] {
+			// on more than one page, as when the list changed while it was read
+			continue
+		}
+		onList[data.Id] = true
+		if current[data.Id] {
+			continue
+		}
+		if trackedById[data.Id] == nil {
+			if err = f.trackUser(ctx, data); err != nil {
+				return result, err
+			}
+			result.Added = append(result.Added, data.UserName)
+		} else {
+			result.Joined = append(result.Joined, data.UserName)
+		}
+		if err = f.Store.AddListMember(ctx, listId, data.Id, now); err != nil {
+			return result, err
+		}
+	}
+	for _, member := range stored {
+		if !member.LeftAt.IsZero() || onList[member.UserId] {
+			continue
+		}
+		if err = f.Store.SetListMemberLeft(ctx, listId, member.UserId, now); err != nil {
+			return result, err
+		}
+		name := member.UserId
+		if user := trackedById[member.UserId]; user != nil {
+			name = user.Name
+		}
+		log.Warn().Str(constants.LoggerId, fetcherLoggerId).Msgf("user '%s' left list '%s'", name, listId)
+		result.Left = append(result.Left, name)
+	}
+	log.Info().Str(constants.LoggerId, fetcherLoggerId).Msgf("synced list '%s' of '%d' members: '%d' added, '%d' joined, "+
+		"'%d' left", listId, len(onList), len(result.Added), len(result.Joined), len(result.Left))
+	return result, nil
+}
+
+// syncLists syncs each of f.Lists, logging the failures as the tweets of the users tracked already can still be read
+func (f *Fetcher) syncLists(ctx context.Context) {
+	for _, listId := range f.Lists {
+		if _, err := f.SyncList(ctx, listId); err != nil {
+			log.Error().Str(constants.LoggerId, fetcherLoggerId).Err(err).Msgf("failed to sync list '%s'", listId)
+			if stopsRun(err) {
+				return
+			}
+		}
+	}
+}
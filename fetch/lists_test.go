@@ -0,0 +1,121 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mrnakumar.com/poli/faketwitter"
+	"reflect"
+	"testing"
+)
+
+const fakeListId = "1234"
+
+func TestSyncList(t *testing.T) {
+	server, fetcher, store := newFakeTwitter(t, 0)
+	if err := fetcher.AddUser(context.Background(), fakeUserName); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	memberIds := []string{fakeUserId, "200"}
+	for i := 0; i < 120; i++ {
+		userName := fmt.Sprintf("member_%d", i)
+		server.AddUser(faketwitter.User{Id: fmt.Sprint(1000 + i), Name: userName, UserName: userName})
+		memberIds = append(memberIds, fmt.Sprint(1000+i))
+	}
+	server.SetListMembers(fakeListId, memberIds...)
+
+	result, err := fetcher.SyncList(context.Background(), fakeListId)
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	// the suspended user is not returned as a member
+	if len(result.Added) != 120 || !reflect.DeepEqual(result.Joined, []string{fakeUserName}) || len(result.Left) != 0 {
+		t.Errorf("result = %+v; expected 120 added and %s joined", result, fakeUserName)
+	}
+	if requests := server.Requests(faketwitter.EndpointListMembers); requests != 2 {
+		t.Errorf("requests = %d; expected = 2", requests)
+	}
+	if users, _ := store.GetAllUsers(context.Background()); len(users) != 121 {
+		t.Errorf("users = %d; expected = 121", len(users))
+	}
+
+	// the first member leaves and a new one joins
+	server.AddUser(faketwitter.User{Id: "2000", Name: "newcomer", UserName: "newcomer"})
+	server.SetListMembers(fakeListId, append(memberIds[1:], "2000")...)
+	result, err = fetcher.SyncList(context.Background(), fakeListId)
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	expected := &ListSyncResult{Added: []string{"newcomer"}, Left: []string{fakeUserName}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("result = %+v; expected = %+v", result, expected)
+	}
+	members, _ := store.GetListMembers(context.Background(), fakeListId)
+	left := 0
+	for _, member := range members {
+		if !member.LeftAt.IsZero() {
+			left++
+			if member.UserId != fakeUserId {
+				t.Errorf("left member = %s; expected = %s", member.UserId, fakeUserId)
+			}
+		}
+	}
+	if len(members) != 122 || left != 1 {
+		t.Errorf("members, left = %d, %d; expected = 122, 1", len(members), left)
+	}
+	// those who left are still tracked
+	if user, _ := store.GetUser(context.Background(), fakeUserName); user == nil {
+		t.Errorf("user = nil; expected %s to be tracked", fakeUserName)
+	}
+
+	// and is back
+	server.SetListMembers(fakeListId, memberIds...)
+	result, err = fetcher.SyncList(context.Background(), fakeListId)
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if !reflect.DeepEqual(result.Joined, []string{fakeUserName}) || !reflect.DeepEqual(result.Left, []string{"newcomer"}) {
+		t.Errorf("result = %+v; expected %s joined and newcomer left", result, fakeUserName)
+	}
+}
+
+func TestSyncListFailureLeavesMembers(t *testing.T) {
+	server, fetcher, store := newFakeTwitter(t, 0)
+	server.SetListMembers(fakeListId, fakeUserId)
+	if _, err := fetcher.SyncList(context.Background(), fakeListId); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if _, err := fetcher.SyncList(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Error = %v; expected %v", err, ErrNotFound)
+	}
+	server.FailNext(faketwitter.EndpointListMembers, 503, 1)
+	if _, err := fetcher.SyncList(context.Background(), fakeListId); err == nil {
+		t.Errorf("Error = nil; expected status code 503")
+	}
+	members, _ := store.GetListMembers(context.Background(), fakeListId)
+	if len(members) != 1 || !members[0].LeftAt.IsZero() {
+		t.Errorf("members = %+v; expected %s still a member", members, fakeUserId)
+	}
+}
+
+func TestSyncListMemberOnTwoPages(t *testing.T) {
+	server, fetcher, store := newFakeTwitter(t, 0)
+	var memberIds []string
+	for i := 0; i < 100; i++ {
+		userName := fmt.Sprintf("member_%d", i)
+		server.AddUser(faketwitter.User{Id: fmt.Sprint(1000 + i), Name: userName, UserName: userName})
+		memberIds = append(memberIds, fmt.Sprint(1000+i))
+	}
+	// the last member of the first page is returned again on the second page
+	server.SetListMembers(fakeListId, append(memberIds, memberIds[99], fakeUserId)...)
+	result, err := fetcher.SyncList(context.Background(), fakeListId)
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if len(result.Added) != 101 {
+		t.Errorf("added = %d; expected = 101", len(result.Added))
+	}
+	if members, _ := store.GetListMembers(context.Background(), fakeListId); len(members) != 101 {
+		t.Errorf("members = %d; expected = 101", len(members))
+	}
+}
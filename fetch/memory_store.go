@@ -0,0 +1,352 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore
+// keeps everything in memory. Meant for tests and local runs that do not need a database.
+type MemoryStore struct {
+	mu          sync.Mutex
+	users       []*User
+	tweets      map[TweetId]storedTweet
+	checkpoints map[checkpointKey]string
+	// listMembers are by the id of the list and then of the user
+	listMembers map[string]map[TwitterUserId]ListMember
+	history     []ProfileChange
+}
+
+var errTxDone = errors.New("transaction has already been committed or rolled back")
+
+type storedTweet struct {
+	Tweet
+	UserId TwitterUserId
+}
+
+type checkpointKey struct {
+	userId TwitterUserId
+	kind   WaterMarkType
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		tweets:      make(map[TweetId]storedTweet),
+		checkpoints: make(map[checkpointKey]string),
+		listMembers: make(map[string]map[TwitterUserId]ListMember),
+	}
+}
+
+func (ms *MemoryStore) GetAllUsers(ctx context.Context) ([]*User, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var users []*User
+	for _, user := range ms.users {
+		copied := *user
+		users = append(users, &copied)
+	}
+	return users, nil
+}
+
+func (ms *MemoryStore) GetUser(ctx context.Context, userName string) (*User, error) {
+	return ms.findUser(func(user *User) bool { return user.Name == userName })
+}
+
+func (ms *MemoryStore) GetUserIgnoringCase(ctx context.Context, userName string) (*User, error) {
+	return ms.findUser(func(user *User) bool { return strings.EqualFold(user.Name, userName) })
+}
+
+func (ms *MemoryStore) findUser(matches func(user *User) bool) (*User, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, user := range ms.users {
+		if matches(user) {
+			copied := *user
+			return &copied, nil
+		}
+	}
+	return nil, nil
+}
+
+func (ms *MemoryStore) AddUser(ctx context.Context, user *User) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, existing := range ms.users {
+		if existing.Id == user.Id {
+			return fmt.Errorf("user with id '%s' already exists", user.Id)
+		}
+	}
+	copied := *user
+	ms.users = append(ms.users, &copied)
+	return nil
+}
+
+func (ms *MemoryStore) UpdateUser(ctx context.Context, user *User, changes []ProfileChange) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for i, existing := range ms.users {
+		if existing.Id == user.Id {
+			copied := *user
+			ms.users[i] = &copied
+			for _, change := range changes {
+				change.ChangedAt = change.ChangedAt.UTC()
+				ms.history = append(ms.history, change)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("user with id '%s' does not exist", user.Id)
+}
+
+func (ms *MemoryStore) GetProfileHistory(ctx context.Context, userId TwitterUserId) ([]*ProfileChange, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var changes []*ProfileChange
+	for _, change := range ms.history {
+		if change.UserId == userId {
+			copied := change
+			changes = append(changes, &copied)
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		if !changes[i].ChangedAt.Equal(changes[j].ChangedAt) {
+			return changes[i].ChangedAt.Before(changes[j].ChangedAt)
+		}
+		return changes[i].Field < changes[j].Field
+	})
+	return changes, nil
+}
+
+func (ms *MemoryStore) RemoveUser(ctx context.Context, userId TwitterUserId) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for i, existing := range ms.users {
+		if existing.Id == userId {
+			ms.users = append(ms.users[:i], ms.users[i+1:]...)
+			break
+		}
+	}
+	for id, tweet := range ms.tweets {
+		if tweet.UserId == userId {
+			delete(ms.tweets, id)
+		}
+	}
+	for key := range ms.checkpoints {
+		if key.userId == userId {
+			delete(ms.checkpoints, key)
+		}
+	}
+	for _, members := range ms.listMembers {
+		delete(members, userId)
+	}
+	history := ms.history[:0]
+	for _, change := range ms.history {
+		if change.UserId != userId {
+			history = append(history, change)
+		}
+	}
+	ms.history = history
+	return nil
+}
+
+func (ms *MemoryStore) SaveTweets(ctx context.Context, userId TwitterUserId, tweets []Tweet) (SaveResult, error) {
+	txn, err := ms.Begin(ctx)
+	if err != nil {
+		return SaveResult{}, err
+	}
+	result, err := txn.SaveTweets(ctx, userId, tweets)
+	if err != nil {
+		return SaveResult{}, err
+	}
+	return result, txn.Commit()
+}
+
+func (ms *MemoryStore) Begin(ctx context.Context) (Tx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &memoryTx{ctx: ctx, ms: ms, tweets: make(map[TweetId]storedTweet), waterMarks: make(map[checkpointKey]string)}, nil
+}
+
+// memoryTx
+// keeps the writes aside until Commit, which applies them at once. The reads of a MemoryStore do not wait, so only
+// Begin and Commit look at the context.
+type memoryTx struct {
+	ctx        context.Context
+	ms         *MemoryStore
+	tweets     map[TweetId]storedTweet
+	waterMarks map[checkpointKey]string
+	done       bool
+}
+
+func (tx *memoryTx) SaveTweets(ctx context.Context, userId TwitterUserId, tweets []Tweet) (SaveResult, error) {
+	if tx.done {
+		return SaveResult{}, errTxDone
+	}
+	var result SaveResult
+	tweets, result.Skipped = lastOfEachTweet(tweets)
+	tx.ms.mu.Lock()
+	defer tx.ms.mu.Unlock()
+	if err := tx.ms.checkUserExists(userId); err != nil {
+		return SaveResult{}, err
+	}
+	for _, tweet := range tweets {
+		stored, exists := tx.tweets[tweet.Id]
+		if !exists {
+			stored, exists = tx.ms.tweets[tweet.Id]
+		}
+		if !exists {
+			result.Inserted++
+			tx.tweets[tweet.Id] = storedTweet{Tweet: tweet, UserId: userId}
+			continue
+		}
+		if reflect.DeepEqual(stored.Tweet, tweet) {
+			result.Skipped++
+			continue
+		}
+		result.Updated++
+		// the user of a tweet never changes
+		tx.tweets[tweet.Id] = storedTweet{Tweet: tweet, UserId: stored.UserId}
+	}
+	return result, nil
+}
+
+func (tx *memoryTx) UpdateWaterMark(ctx context.Context, userId TwitterUserId, kind WaterMarkType, waterMark string) error {
+	if tx.done {
+		return errTxDone
+	}
+	tx.ms.mu.Lock()
+	defer tx.ms.mu.Unlock()
+	if err := tx.ms.checkUserExists(userId); err != nil {
+		return err
+	}
+	tx.waterMarks[checkpointKey{userId: userId, kind: kind}] = waterMark
+	return nil
+}
+
+func (tx *memoryTx) Commit() error {
+	if tx.done {
+		return errTxDone
+	}
+	tx.done = true
+	// as the SQL stores do, a transaction is rolled back once its context is done
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+	tx.ms.mu.Lock()
+	defer tx.ms.mu.Unlock()
+	for _, tweet := range tx.tweets {
+		if err := tx.ms.checkUserExists(tweet.UserId); err != nil {
+			return err
+		}
+	}
+	for key := range tx.waterMarks {
+		if err := tx.ms.checkUserExists(key.userId); err != nil {
+			return err
+		}
+	}
+	for _, tweet := range tx.tweets {
+		tx.ms.tweets[tweet.Id] = tweet
+	}
+	for key, waterMark := range tx.waterMarks {
+		tx.ms.checkpoints[key] = waterMark
+	}
+	return nil
+}
+
+func (tx *memoryTx) Rollback() error {
+	tx.done = true
+	return nil
+}
+
+func (ms *MemoryStore) GetOldestTweetId(ctx context.Context, userId TwitterUserId) (TweetId, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var oldest TweetId
+	for id, tweet := range ms.tweets {
+		if tweet.UserId == userId && (len(oldest) == 0 || isOlder(id, oldest)) {
+			oldest = id
+		}
+	}
+	return oldest, nil
+}
+
+func (ms *MemoryStore) GetWaterMark(ctx context.Context, userId TwitterUserId, kind WaterMarkType) (string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.checkpoints[checkpointKey{userId: userId, kind: kind}], nil
+}
+
+func (ms *MemoryStore) UpdateWaterMark(ctx context.Context, userId TwitterUserId, kind WaterMarkType, waterMark string) error {
+	txn, err := ms.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	err = txn.UpdateWaterMark(ctx, userId, kind, waterMark)
+	if err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+func (ms *MemoryStore) GetListMembers(ctx context.Context, listId string) ([]*ListMember, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var members []*ListMember
+	for _, member := range ms.listMembers[listId] {
+		copied := member
+		members = append(members, &copied)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if !members[i].JoinedAt.Equal(members[j].JoinedAt) {
+			return members[i].JoinedAt.Before(members[j].JoinedAt)
+		}
+		return members[i].UserId < members[j].UserId
+	})
+	return members, nil
+}
+
+func (ms *MemoryStore) AddListMember(ctx context.Context, listId string, userId TwitterUserId, at time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if err := ms.checkUserExists(userId); err != nil {
+		return err
+	}
+	if ms.listMembers[listId] == nil {
+		ms.listMembers[listId] = make(map[TwitterUserId]ListMember)
+	}
+	ms.listMembers[listId][userId] = ListMember{ListId: listId, UserId: userId, JoinedAt: at.UTC()}
+	return nil
+}
+
+func (ms *MemoryStore) SetListMemberLeft(ctx context.Context, listId string, userId TwitterUserId, at time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	member, ok := ms.listMembers[listId][userId]
+	if !ok {
+		return fmt.Errorf("user with id '%s' is not a member of list '%s'", userId, listId)
+	}
+	member.LeftAt = at.UTC()
+	ms.listMembers[listId][userId] = member
+	return nil
+}
+
+// checkUserExists mirrors the foreign keys of the SQL stores. Callers must hold mu.
+func (ms *MemoryStore) checkUserExists(userId TwitterUserId) error {
+	for _, user := range ms.users {
+		if user.Id == userId {
+			return nil
+		}
+	}
+	return fmt.Errorf("user with id '%s' does not exist", userId)
+}
+
+func (ms *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,260 @@
+package fetch
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"mrnakumar.com/poli/constants"
+	"time"
+)
+
+const migrationsLoggerId = "migrations"
+
+// LatestSchemaVersion can be given to Migrate to apply every migration
+const LatestSchemaVersion = -1
+
+// Migrator
+// is implemented by stores with a versioned schema.
+type Migrator interface {
+	// Migrate moves the schema up or down to the target version
+	Migrate(ctx context.Context, target int) error
+	// SchemaVersion returns 0 if no migration has been applied
+	SchemaVersion(ctx context.Context) (int, error)
+}
+
+type migration struct {
+	version int
+	name    string
+	// statements are keyed by driver
+	up   map[string][]string
+	down map[string][]string
+}
+
+func forAllDrivers(statements ...string) map[string][]string {
+	return map[string][]string{driverPostgres: statements, driverSqlite: statements}
+}
+
+// migrations must be ordered by version, starting at 1 and without gaps. Never edit one that has been released,
+// add a new one instead.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create_tables",
+		// 'IF NOT EXISTS' adopts the databases created from the former ddl.json
+		up: forAllDrivers(
+			"CREATE TABLE IF NOT EXISTS users (id varchar (120) NOT NULL PRIMARY KEY, name varchar(500) NOT NULL, profile_image varchar(500))",
+			"CREATE TABLE IF NOT EXISTS tweets (id varchar (120) NOT NULL PRIMARY KEY, text varchar(400) NOT NULL, lang varchar(4) NOT NULL, user_id varchar (120) NOT NULL,  visible boolean DEFAULT 'false' NOT NULL)",
+			"CREATE TABLE IF NOT EXISTS checkpoint (user_id varchar(200) NOT NULL, type varchar(20) NOT NULL, watermark varchar(200) NOT NULL, PRIMARY KEY (user_id, type))",
+		),
+		down: forAllDrivers(
+			"DROP TABLE checkpoint",
+			"DROP TABLE tweets",
+			"DROP TABLE users",
+		),
+	},
+	{
+		version: 2,
+		name:    "add_foreign_keys_and_indexes",
+		up: map[string][]string{
+			driverPostgres: {
+				"ALTER TABLE tweets ADD CONSTRAINT tweets_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id)",
+				"ALTER TABLE checkpoint ADD CONSTRAINT checkpoint_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id)",
+				"CREATE INDEX tweets_user_id_idx ON tweets (user_id)",
+				"CREATE INDEX users_name_idx ON users (name)",
+			},
+			// SQLite cannot add a constraint to an existing table, so the tables are rebuilt
+			driverSqlite: {
+				"CREATE TABLE tweets_new (id varchar (120) NOT NULL PRIMARY KEY, text varchar(400) NOT NULL, lang varchar(4) NOT NULL, user_id varchar (120) NOT NULL REFERENCES users (id),  visible boolean DEFAULT 'false' NOT NULL)",
+				"INSERT INTO tweets_new SELECT id, text, lang, user_id, visible FROM tweets",
+				"DROP TABLE tweets",
+				"ALTER TABLE tweets_new RENAME TO tweets",
+				"CREATE TABLE checkpoint_new (user_id varchar(200) NOT NULL REFERENCES users (id), type varchar(20) NOT NULL, watermark varchar(200) NOT NULL, PRIMARY KEY (user_id, type))",
+				"INSERT INTO checkpoint_new SELECT user_id, type, watermark FROM checkpoint",
+				"DROP TABLE checkpoint",
+				"ALTER TABLE checkpoint_new RENAME TO checkpoint",
+				"CREATE INDEX tweets_user_id_idx ON tweets (user_id)",
+				"CREATE INDEX users_name_idx ON users (name)",
+			},
+		},
+		down: map[string][]string{
+			driverPostgres: {
+				"DROP INDEX users_name_idx",
+				"DROP INDEX tweets_user_id_idx",
+				"ALTER TABLE checkpoint DROP CONSTRAINT checkpoint_user_id_fkey",
+				"ALTER TABLE tweets DROP CONSTRAINT tweets_user_id_fkey",
+			},
+			driverSqlite: {
+				"DROP INDEX users_name_idx",
+				"DROP INDEX tweets_user_id_idx",
+				"CREATE TABLE checkpoint_old (user_id varchar(200) NOT NULL, type varchar(20) NOT NULL, watermark varchar(200) NOT NULL, PRIMARY KEY (user_id, type))",
+				"INSERT INTO checkpoint_old SELECT user_id, type, watermark FROM checkpoint",
+				"DROP TABLE checkpoint",
+				"ALTER TABLE checkpoint_old RENAME TO checkpoint",
+				"CREATE TABLE tweets_old (id varchar (120) NOT NULL PRIMARY KEY, text varchar(400) NOT NULL, lang varchar(4) NOT NULL, user_id varchar (120) NOT NULL,  visible boolean DEFAULT 'false' NOT NULL)",
+				"INSERT INTO tweets_old SELECT id, text, lang, user_id, visible FROM tweets",
+				"DROP TABLE tweets",
+				"ALTER TABLE tweets_old RENAME TO tweets",
+			},
+		},
+	},
+	{
+		version: 3,
+		name:    "add_users_lower_name_index",
+		up:      forAllDrivers("CREATE INDEX users_lower_name_idx ON users (lower(name))"),
+		down:    forAllDrivers("DROP INDEX users_lower_name_idx"),
+	},
+	{
+		version: 4,
+		name:    "add_tweet_details",
+		up: forAllDrivers(
+			"ALTER TABLE tweets ADD COLUMN created_at timestamp",
+			"ALTER TABLE tweets ADD COLUMN author_id varchar(120)",
+			"ALTER TABLE tweets ADD COLUMN conversation_id varchar(120)",
+			"ALTER TABLE tweets ADD COLUMN in_reply_to_user_id varchar(120)",
+			"ALTER TABLE tweets ADD COLUMN possibly_sensitive boolean DEFAULT false NOT NULL",
+			"ALTER TABLE tweets ADD COLUMN retweet_count integer",
+			"ALTER TABLE tweets ADD COLUMN reply_count integer",
+			"ALTER TABLE tweets ADD COLUMN like_count integer",
+			"ALTER TABLE tweets ADD COLUMN quote_count integer",
+			// tweets are only read from the timeline of their author
+			"UPDATE tweets SET author_id = user_id",
+			"CREATE TABLE tweet_references (tweet_id varchar(120) NOT NULL REFERENCES tweets (id), type varchar(20) NOT NULL, referenced_tweet_id varchar(120) NOT NULL, PRIMARY KEY (tweet_id, type, referenced_tweet_id))",
+			"CREATE INDEX tweet_references_referenced_tweet_id_idx ON tweet_references (referenced_tweet_id)",
+			"CREATE TABLE tweet_entities (tweet_id varchar(120) NOT NULL REFERENCES tweets (id), type varchar(20) NOT NULL, start_index integer NOT NULL, end_index integer NOT NULL, value varchar(2000) NOT NULL, entity_id varchar(120), PRIMARY KEY (tweet_id, type, start_index))",
+			"CREATE INDEX tweet_entities_type_value_idx ON tweet_entities (type, value)",
+		),
+		down: forAllDrivers(
+			"DROP TABLE tweet_entities",
+			"DROP TABLE tweet_references",
+			"ALTER TABLE tweets DROP COLUMN quote_count",
+			"ALTER TABLE tweets DROP COLUMN like_count",
+			"ALTER TABLE tweets DROP COLUMN reply_count",
+			"ALTER TABLE tweets DROP COLUMN retweet_count",
+			"ALTER TABLE tweets DROP COLUMN possibly_sensitive",
+			"ALTER TABLE tweets DROP COLUMN in_reply_to_user_id",
+			"ALTER TABLE tweets DROP COLUMN conversation_id",
+			"ALTER TABLE tweets DROP COLUMN author_id",
+			"ALTER TABLE tweets DROP COLUMN created_at",
+		),
+	},
+	{
+		version: 5,
+		name:    "add_list_members",
+		up: forAllDrivers(
+			"CREATE TABLE list_members (list_id varchar(120) NOT NULL, user_id varchar(120) NOT NULL REFERENCES users (id), joined_at timestamp NOT NULL, left_at timestamp, PRIMARY KEY (list_id, user_id))",
+			"CREATE INDEX list_members_user_id_idx ON list_members (user_id)",
+		),
+		down: forAllDrivers("DROP TABLE list_members"),
+	},
+	{
+		version: 6,
+		name:    "add_user_profiles",
+		up: forAllDrivers(
+			"ALTER TABLE users ADD COLUMN display_name varchar(500)",
+			"ALTER TABLE users ADD COLUMN description varchar(1000)",
+			"ALTER TABLE users ADD COLUMN location varchar(500)",
+			"ALTER TABLE users ADD COLUMN url varchar(1000)",
+			"ALTER TABLE users ADD COLUMN verified boolean DEFAULT false NOT NULL",
+			"ALTER TABLE users ADD COLUMN protected boolean DEFAULT false NOT NULL",
+			"CREATE TABLE user_profile_history (user_id varchar(120) NOT NULL REFERENCES users (id), field varchar(40) NOT NULL, old_value varchar(1000), new_value varchar(1000), changed_at timestamp NOT NULL)",
+			"CREATE INDEX user_profile_history_user_id_idx ON user_profile_history (user_id, changed_at)",
+		),
+		down: forAllDrivers(
+			"DROP TABLE user_profile_history",
+			"ALTER TABLE users DROP COLUMN protected",
+			"ALTER TABLE users DROP COLUMN verified",
+			"ALTER TABLE users DROP COLUMN url",
+			"ALTER TABLE users DROP COLUMN location",
+			"ALTER TABLE users DROP COLUMN description",
+			"ALTER TABLE users DROP COLUMN display_name",
+		),
+	},
+}
+
+func (ds *Database) SchemaVersion(ctx context.Context) (int, error) {
+	err := ds.createMigrationsTable(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var version sql.NullInt64
+	err = ds.DB.QueryRowContext(ctx, "SELECT max(version) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// Migrate
+// applies the up steps of the migrations after the current version up to target, or the down steps from the current
+// version down to the one after target if target is lower. Each migration runs in its own transaction.
+// Use LatestSchemaVersion as target to apply all the migrations.
+func (ds *Database) Migrate(ctx context.Context, target int) error {
+	if target == LatestSchemaVersion {
+		target = migrations[len(migrations)-1].version
+	}
+	if target < 0 || target > migrations[len(migrations)-1].version {
+		return fmt.Errorf("unknown schema version '%d', latest is '%d'", target, migrations[len(migrations)-1].version)
+	}
+	current, err := ds.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version > current && m.version <= target {
+			err = ds.applyMigration(ctx, m, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version <= current && m.version > target {
+			err = ds.applyMigration(ctx, m, false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ds *Database) applyMigration(ctx context.Context, m migration, up bool) error {
+	statements, direction := m.up[ds.driver], "up"
+	if !up {
+		statements, direction = m.down[ds.driver], "down"
+	}
+	txn, err := ds.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		_, err = txn.ExecContext(ctx, statement)
+		if err != nil {
+			rollbackOrLog(txn)
+			return fmt.Errorf("migration '%d_%s' %s failed: %w", m.version, m.name, direction, err)
+		}
+	}
+	if up {
+		_, err = txn.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)",
+			m.version, m.name, time.Now().UTC())
+	} else {
+		_, err = txn.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1", m.version)
+	}
+	if err != nil {
+		rollbackOrLog(txn)
+		return err
+	}
+	err = txn.Commit()
+	if err != nil {
+		return err
+	}
+	log.Info().Str(constants.LoggerId, migrationsLoggerId).Msgf("applied migration '%d_%s' %s", m.version, m.name, direction)
+	return nil
+}
+
+func (ds *Database) createMigrationsTable(ctx context.Context) error {
+	_, err := ds.DB.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version integer NOT NULL PRIMARY KEY, name varchar(200) NOT NULL, applied_at timestamp NOT NULL)")
+	return err
+}
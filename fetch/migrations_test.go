@@ -0,0 +1,105 @@
+package fetch
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateUpAndDown(t *testing.T) {
+	store, err := OpenStore(sqliteScheme + filepath.Join(t.TempDir(), "poli.db"))
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	defer store.Close()
+	ds := store.(*Database)
+	latest := migrations[len(migrations)-1].version
+
+	if err = ds.Migrate(context.Background(), LatestSchemaVersion); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	assertSchemaVersion(t, ds, latest)
+	// applying again is a no-op
+	if err = ds.Migrate(context.Background(), LatestSchemaVersion); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if err = ds.Migrate(context.Background(), 0); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	assertSchemaVersion(t, ds, 0)
+	if _, err = ds.GetAllUsers(context.Background()); err == nil {
+		t.Error("expected error as users table is dropped")
+	}
+	if err = ds.Migrate(context.Background(), latest); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	assertSchemaVersion(t, ds, latest)
+}
+
+func TestMigrateKeepsRows(t *testing.T) {
+	ds := newSqliteStore(t)
+	if err := ds.Migrate(context.Background(), 1); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	// rows as written by the first schema
+	for _, statement := range []string{
+		"INSERT INTO users VALUES ('" + userId + "', '" + userName + "', NULL)",
+		"INSERT INTO tweets (id, text, lang, user_id) VALUES ('1', 'one', 'en', '" + userId + "')",
+		"INSERT INTO checkpoint VALUES ('" + userId + "', 'twitter', '1')",
+	} {
+		if _, err := ds.DB.Exec(statement); err != nil {
+			t.Fatalf("Error = %v; expected nil", err)
+		}
+	}
+	if err := ds.Migrate(context.Background(), LatestSchemaVersion); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if count := countTweets(t, ds); count != 1 {
+		t.Errorf("stored tweets = %d; expected = 1", count)
+	}
+	if sinceId, _ := ds.GetWaterMark(context.Background(), userId, tweetWaterMark); sinceId != "1" {
+		t.Errorf("since id = '%s'; expected = '1'", sinceId)
+	}
+	var authorId string
+	if err := ds.DB.QueryRow("SELECT author_id FROM tweets WHERE id = '1'").Scan(&authorId); err != nil || authorId != userId {
+		t.Errorf("author id = '%s', error = %v; expected '%s'", authorId, err, userId)
+	}
+}
+
+func TestTweetsRequireKnownUser(t *testing.T) {
+	ds := newSqliteStore(t)
+	_, err := ds.SaveTweets(context.Background(), "unknown", []Tweet{{Id: "1", Text: "one", Lang: "en"}})
+	if err == nil {
+		t.Error("expected foreign key error to be present")
+	}
+}
+
+func TestMigrateUnknownVersion(t *testing.T) {
+	ds := newSqliteStore(t)
+	if err := ds.Migrate(context.Background(), len(migrations)+1); err == nil {
+		t.Error("expected error to be present")
+	}
+}
+
+func TestMigrationsAreOrdered(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration '%s' has version %d; expected %d", m.name, m.version, i+1)
+		}
+		for _, driver := range []string{driverPostgres, driverSqlite} {
+			if len(m.up[driver]) == 0 || len(m.down[driver]) == 0 {
+				t.Errorf("migration '%s' is missing statements for driver '%s'", m.name, driver)
+			}
+		}
+	}
+}
+
+func assertSchemaVersion(t *testing.T, ds *Database, expected int) {
+	version, err := ds.SchemaVersion(context.Background())
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if version != expected {
+		t.Errorf("schema version = %d; expected = %d", version, expected)
+	}
+}
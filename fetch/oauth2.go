@@ -0,0 +1,109 @@
+package fetch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"mrnakumar.com/poli/constants"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const oauth2LoggerId = "oauth2"
+const oauth2TokenEndpoint = "/oauth2/token"
+
+// TokenSource
+// gives the bearer token of the requests to twitter.
+type TokenSource interface {
+	// Token returns the token to send
+	Token(ctx context.Context) (string, error)
+	// Invalidate is called with a token twitter rejected, so that it is not given again
+	Invalidate(token string)
+}
+
+// AppTokenSource
+// obtains the app-only bearer token from the consumer key and secret of the app with the client credentials flow of
+// oauth2/token. The token is cached until it is invalidated. It is safe for concurrent use.
+type AppTokenSource struct {
+	ConsumerKey    string
+	ConsumerSecret string
+	Client         HttpClient
+	// BaseUrl is DefaultBaseUrl if empty
+	BaseUrl string
+	mu      sync.Mutex
+	token   string
+}
+
+func NewAppTokenSource(consumerKey string, consumerSecret string, client HttpClient) *AppTokenSource {
+	return &AppTokenSource{ConsumerKey: consumerKey, ConsumerSecret: consumerSecret, Client: client}
+}
+
+// Token
+// returns the cached token, requesting one first if there is none. Concurrent callers wait for the same request.
+func (s *AppTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.token) > 0 {
+		return s.token, nil
+	}
+	token, err := s.requestToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	s.token = token
+	return token, nil
+}
+
+// Invalidate drops token if it is still the cached one, so that the next call to Token requests a new one
+func (s *AppTokenSource) Invalidate(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == token {
+		s.token = ""
+	}
+}
+
+func (s *AppTokenSource) requestToken(ctx context.Context) (string, error) {
+	tokenUrl := baseUrlOrDefault(s.BaseUrl) + oauth2TokenEndpoint
+	body := strings.NewReader(url.Values{"grant_type": {"client_credentials"}}.Encode())
+	req, err := http.NewRequestWithContext(ctx, "POST", tokenUrl, body)
+	if err != nil {
+		return "", err
+	}
+	// twitter takes the key and secret url encoded before they are joined
+	req.SetBasicAuth(url.QueryEscape(s.ConsumerKey), url.QueryEscape(s.ConsumerSecret))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded;charset=UTF-8")
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return "", transientError{fmt.Errorf("token request failed for url '%s': %w", tokenUrl, err)}
+	}
+	defer closeOrLogWarningIfFailed(res.Body)
+	msg, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", transientError{fmt.Errorf("failed to read token response for url '%s': %w: %v", tokenUrl, ErrInvalidResponse, err)}
+	}
+	if res.StatusCode != http.StatusOK {
+		var failure problem
+		_ = json.Unmarshal(msg, &failure)
+		twitterErr := newTwitterError(res.StatusCode, tokenUrl, failure.Errors)
+		// twitter refuses a wrong key or secret with 403
+		if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+			twitterErr.kind = ErrUnauthorized
+		}
+		return "", twitterErr
+	}
+	var token struct {
+		TokenType   string `json:"token_type"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.Unmarshal(msg, &token)
+	if err != nil || !strings.EqualFold(token.TokenType, "bearer") || len(token.AccessToken) == 0 {
+		return "", fmt.Errorf("no bearer token in the response for url '%s': %w", tokenUrl, ErrInvalidResponse)
+	}
+	log.Info().Str(constants.LoggerId, oauth2LoggerId).Msg("obtained app-only bearer token")
+	return token.AccessToken, nil
+}
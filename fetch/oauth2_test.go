@@ -0,0 +1,121 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const consumerKey = "key+1"
+const consumerSecret = "secret/1"
+
+// fakeTokenServer
+// is a local oauth2/token endpoint handing out 'token-1', 'token-2' and so on, and a user lookup accepting only the
+// tokens in valid.
+type fakeTokenServer struct {
+	*httptest.Server
+	tokenRequests int32
+	valid         map[string]bool
+}
+
+func newFakeTokenServer(t *testing.T, valid ...string) *fakeTokenServer {
+	s := &fakeTokenServer{valid: make(map[string]bool)}
+	for _, token := range valid {
+		s.valid[token] = true
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		key, secret, ok := r.BasicAuth()
+		if r.Method != "POST" || !ok || key != "key%2B1" || secret != "secret%2F1" ||
+			r.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":[{"code":99,"message":"Unable to verify your credentials","label":"authenticity_token_error"}]}`))
+			return
+		}
+		n := atomic.AddInt32(&s.tokenRequests, 1)
+		_, _ = fmt.Fprintf(w, `{"token_type":"bearer","access_token":"token-%d"}`, n)
+	})
+	mux.HandleFunc("/2/users/by/username/", func(w http.ResponseWriter, r *http.Request) {
+		if !s.valid[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"title": "Unauthorized", "type": "about:blank", "status": 401, "detail": "Unauthorized"}`))
+			return
+		}
+		_, _ = w.Write([]byte(user))
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Do sends the requests for twitter to the fake server
+func (s *fakeTokenServer) Do(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme = "http"
+	req.URL.Host = strings.TrimPrefix(s.URL, "http://")
+	return s.Client().Do(req)
+}
+
+func TestAppTokenSourceCachesToken(t *testing.T) {
+	server := newFakeTokenServer(t)
+	tokens := NewAppTokenSource(consumerKey, consumerSecret, server)
+	for i := 0; i < 2; i++ {
+		token, err := tokens.Token(context.Background())
+		if err != nil {
+			t.Fatalf("Error = %v; expected nil", err)
+		}
+		if token != "token-1" {
+			t.Errorf("token = %s; expected = token-1", token)
+		}
+	}
+	tokens.Invalidate("token-1")
+	if token, _ := tokens.Token(context.Background()); token != "token-2" {
+		t.Errorf("token = %s; expected = token-2", token)
+	}
+	if server.tokenRequests != 2 {
+		t.Errorf("token requests = %d; expected = 2", server.tokenRequests)
+	}
+}
+
+func TestAppTokenSourceRejectsCredentials(t *testing.T) {
+	server := newFakeTokenServer(t)
+	tokens := NewAppTokenSource(consumerKey, "wrong", server)
+	_, err := tokens.Token(context.Background())
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Error = %v; expected %v", err, ErrUnauthorized)
+	}
+	if !strings.Contains(err.Error(), "Unable to verify your credentials") {
+		t.Errorf("Error = %v; expected the message of twitter", err)
+	}
+}
+
+func TestUnauthorizedRefreshesToken(t *testing.T) {
+	server := newFakeTokenServer(t, "token-2")
+	twitterClient := HttpTwitterClient{Tokens: NewAppTokenSource(consumerKey, consumerSecret, server), Client: server}
+	response, err := twitterClient.FindUser(context.Background(), userName)
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if response.Data.Id != userId {
+		t.Errorf("user id = %s; expected = %s", response.Data.Id, userId)
+	}
+	if server.tokenRequests != 2 {
+		t.Errorf("token requests = %d; expected = 2", server.tokenRequests)
+	}
+}
+
+func TestUnauthorizedAfterRefresh(t *testing.T) {
+	server := newFakeTokenServer(t)
+	twitterClient := HttpTwitterClient{Tokens: NewAppTokenSource(consumerKey, consumerSecret, server), Client: server}
+	_, err := twitterClient.FindUser(context.Background(), userName)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Error = %v; expected %v", err, ErrUnauthorized)
+	}
+	if server.tokenRequests != 2 {
+		t.Errorf("token requests = %d; expected = 2", server.tokenRequests)
+	}
+}
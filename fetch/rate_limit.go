@@ -0,0 +1,142 @@
+package fetch
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"mrnakumar.com/poli/constants"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const rateLimitLoggerId = "rate_limit"
+
+// Endpoints are rate limited independently by twitter
+const (
+	EndpointUserTweets = "/2/users/:id/tweets"
+	EndpointUserByName = "/2/users/by/username/:username"
+	EndpointUserById   = "/2/users/:id"
+	// EndpointUsersByName looks up several users by name
+	EndpointUsersByName = "/2/users/by"
+	EndpointListMembers = "/2/lists/:id/members"
+)
+
+const (
+	headerRateLimit          = "x-rate-limit-limit"
+	headerRateLimitRemaining = "x-rate-limit-remaining"
+	headerRateLimitReset     = "x-rate-limit-reset"
+)
+
+// rateLimitWindow is used when a 429 response does not tell when the limit resets
+const rateLimitWindow = 15 * time.Minute
+
+// waits beyond the reset time reported by twitter to allow for clock differences
+const rateLimitResetMargin = time.Second
+
+// RateLimit
+// is the request budget of an endpoint in the current window.
+type RateLimit struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+// RateLimiter
+// tracks the RateLimit of each endpoint from the response headers and holds requests back once a budget is spent
+// until it is reset. It is safe for concurrent use.
+type RateLimiter struct {
+	mu     sync.Mutex
+	limits map[string]RateLimit
+	now    func() time.Time
+	sleep  func(ctx context.Context, d time.Duration) error
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		limits: make(map[string]RateLimit),
+		now:    time.Now,
+		sleep:  sleepContext,
+	}
+}
+
+// Get returns false if nothing is known about the endpoint yet
+func (rl *RateLimiter) Get(endpoint string) (RateLimit, bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	limit, ok := rl.limits[endpoint]
+	return limit, ok
+}
+
+// All returns the RateLimit of every endpoint that has been called
+func (rl *RateLimiter) All() map[string]RateLimit {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	all := make(map[string]RateLimit, len(rl.limits))
+	for endpoint, limit := range rl.limits {
+		all[endpoint] = limit
+	}
+	return all
+}
+
+// acquire blocks until the endpoint has budget left and takes one request out of it. It returns the error of ctx if
+// ctx is done first.
+func (rl *RateLimiter) acquire(ctx context.Context, endpoint string) error {
+	for {
+		wait := rl.tryAcquire(endpoint)
+		if wait == 0 {
+			return nil
+		}
+		log.Info().Str(constants.LoggerId, rateLimitLoggerId).Msgf("rate limit of '%s' exhausted, waiting '%s' for reset",
+			endpoint, wait)
+		if err := rl.sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// tryAcquire takes one request out of the budget of endpoint if there is any left, otherwise it returns how long
+// until the budget is reset
+func (rl *RateLimiter) tryAcquire(endpoint string) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	limit, ok := rl.limits[endpoint]
+	now := rl.now()
+	if !ok || limit.Remaining > 0 || !now.Before(limit.Reset) {
+		if ok && limit.Remaining > 0 {
+			limit.Remaining--
+			rl.limits[endpoint] = limit
+		}
+		return 0
+	}
+	return limit.Reset.Sub(now) + rateLimitResetMargin
+}
+
+// update records the budget reported in the headers of a response from endpoint
+func (rl *RateLimiter) update(endpoint string, header http.Header) {
+	remaining, err := strconv.Atoi(header.Get(headerRateLimitRemaining))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(header.Get(headerRateLimitReset), 10, 64)
+	if err != nil {
+		return
+	}
+	limit, _ := strconv.Atoi(header.Get(headerRateLimit))
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.limits[endpoint] = RateLimit{Limit: limit, Remaining: remaining, Reset: time.Unix(reset, 0)}
+}
+
+// exhausted records that twitter refused a request to endpoint, so that the next acquire waits for the reset
+func (rl *RateLimiter) exhausted(endpoint string, header http.Header) {
+	rl.update(endpoint, header)
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	limit, ok := rl.limits[endpoint]
+	if !ok || !rl.now().Before(limit.Reset) {
+		limit.Reset = rl.now().Add(rateLimitWindow)
+	}
+	limit.Remaining = 0
+	rl.limits[endpoint] = limit
+}
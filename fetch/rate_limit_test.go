@@ -0,0 +1,146 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// rateLimitedClient answers with the given status codes in turn, followed by the user of FindUser
+type rateLimitedClient struct {
+	statusCodes []int
+	remaining   int
+	reset       time.Time
+	requests    int
+}
+
+func (c *rateLimitedClient) Do(_ *http.Request) (*http.Response, error) {
+	statusCode := http.StatusOK
+	if c.requests < len(c.statusCodes) {
+		statusCode = c.statusCodes[c.requests]
+	}
+	c.requests++
+	header := http.Header{}
+	header.Set(headerRateLimit, "900")
+	header.Set(headerRateLimitRemaining, strconv.Itoa(c.remaining))
+	header.Set(headerRateLimitReset, strconv.FormatInt(c.reset.Unix(), 10))
+	body := user
+	if statusCode != http.StatusOK {
+		body = `{"title": "Too Many Requests"}`
+	}
+	return &http.Response{
+		StatusCode: statusCode,
+		Header:     header,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(body))),
+	}, nil
+}
+
+// newTestRateLimiter sleeps by moving its clock forward
+func newTestRateLimiter(now time.Time) (*RateLimiter, *[]time.Duration) {
+	var sleeps []time.Duration
+	limiter := NewRateLimiter()
+	limiter.now = func() time.Time { return now }
+	limiter.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		now = now.Add(d)
+		return nil
+	}
+	return limiter, &sleeps
+}
+
+func TestRateLimitedRequestWaitsForReset(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	limiter, sleeps := newTestRateLimiter(now)
+	client := &rateLimitedClient{statusCodes: []int{http.StatusTooManyRequests}, remaining: 0, reset: now.Add(time.Minute)}
+	twitterClient := HttpTwitterClient{Client: client, RateLimits: limiter}
+	response, err := twitterClient.FindUser(context.Background(), userName)
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if response.Data.Id != userId {
+		t.Errorf("user id = '%s'; expected '%s'", response.Data.Id, userId)
+	}
+	if client.requests != 2 {
+		t.Errorf("requests = %d; expected = 2", client.requests)
+	}
+	if len(*sleeps) != 1 || (*sleeps)[0] != time.Minute+rateLimitResetMargin {
+		t.Errorf("sleeps = %v; expected a single wait of %s", *sleeps, time.Minute+rateLimitResetMargin)
+	}
+}
+
+func TestRateLimitedRequestGivesUp(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	limiter, _ := newTestRateLimiter(now)
+	statusCodes := make([]int, maxRateLimitedAttempts)
+	for i := range statusCodes {
+		statusCodes[i] = http.StatusTooManyRequests
+	}
+	client := &rateLimitedClient{statusCodes: statusCodes, reset: now.Add(time.Minute)}
+	twitterClient := HttpTwitterClient{Client: client, RateLimits: limiter}
+	_, err := twitterClient.FindUser(context.Background(), userName)
+	if err == nil {
+		t.Error("expected error to be present")
+	}
+	if client.requests != maxRateLimitedAttempts {
+		t.Errorf("requests = %d; expected = %d", client.requests, maxRateLimitedAttempts)
+	}
+}
+
+func TestExhaustedBudgetWaitsBeforeRequest(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	limiter, sleeps := newTestRateLimiter(now)
+	client := &rateLimitedClient{remaining: 1, reset: now.Add(10 * time.Second)}
+	twitterClient := HttpTwitterClient{Client: client, RateLimits: limiter}
+	for i := 0; i < 2; i++ {
+		if _, err := twitterClient.FindUser(context.Background(), userName); err != nil {
+			t.Fatalf("Error = %v; expected nil", err)
+		}
+		// the second response leaves no budget
+		client.remaining = 0
+	}
+	if len(*sleeps) != 0 {
+		t.Errorf("sleeps = %v; expected none while budget remains", *sleeps)
+	}
+	limit, ok := twitterClient.RateLimits.Get(EndpointUserByName)
+	if !ok || limit.Remaining != 0 || limit.Limit != 900 || !limit.Reset.Equal(now.Add(10*time.Second)) {
+		t.Errorf("rate limit = %+v, %v; expected 0 of 900 remaining", limit, ok)
+	}
+	if _, err := twitterClient.FindUser(context.Background(), userName); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if len(*sleeps) != 1 {
+		t.Errorf("sleeps = %v; expected one wait for the reset", *sleeps)
+	}
+	if _, ok = twitterClient.RateLimits.Get(EndpointUserTweets); ok {
+		t.Error("expected no rate limit for an endpoint that was not called")
+	}
+}
+
+func TestRateLimitWithoutHeadersUsesWindow(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	limiter, _ := newTestRateLimiter(now)
+	limiter.exhausted(EndpointUserTweets, http.Header{})
+	limit, _ := limiter.Get(EndpointUserTweets)
+	if limit.Remaining != 0 || !limit.Reset.Equal(now.Add(rateLimitWindow)) {
+		t.Errorf("rate limit = %+v; expected reset after %s", limit, rateLimitWindow)
+	}
+}
+
+func TestExhaustedBudgetWaitIsCancelled(t *testing.T) {
+	limiter := NewRateLimiter()
+	header := http.Header{}
+	header.Set(headerRateLimitRemaining, "0")
+	header.Set(headerRateLimitReset, strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	limiter.update(EndpointUserTweets, header)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := limiter.acquire(ctx, EndpointUserTweets)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Error = %v; expected %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,92 @@
+package fetch
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy
+// decides which failed requests are sent again and how long to wait before each attempt.
+// The wait grows exponentially from InitialBackoff up to MaxBackoff and a random part of it is taken (full jitter),
+// so that clients failing together do not retry together.
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt. Requests are not retried if it is 1 or less.
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// RetryableStatusCodes are retried in addition to failures to send the request or read the response
+	RetryableStatusCodes []int
+	random               func() float64
+	sleep                func(ctx context.Context, d time.Duration) error
+}
+
+// DefaultRetryPolicy
+// retries server errors and network failures three times, waiting up to 1, 2 and 4 seconds.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: time.Second,
+		MaxBackoff:     30 * time.Second,
+		RetryableStatusCodes: []int{
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
+	}
+}
+
+// allowsRetry returns whether another attempt may follow attempt, counting from 1
+func (p *RetryPolicy) allowsRetry(attempt int) bool {
+	return p != nil && attempt < p.MaxAttempts
+}
+
+func (p *RetryPolicy) isRetryable(statusCode int) bool {
+	if p == nil {
+		return false
+	}
+	for _, retryable := range p.RetryableStatusCodes {
+		if statusCode == retryable {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the wait before the attempt following attempt
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.InitialBackoff
+	for i := 1; i < attempt && ceiling < p.MaxBackoff; i++ {
+		ceiling *= 2
+	}
+	if ceiling > p.MaxBackoff {
+		ceiling = p.MaxBackoff
+	}
+	random := rand.Float64
+	if p.random != nil {
+		random = p.random
+	}
+	return time.Duration(random() * float64(ceiling))
+}
+
+// wait returns the error of ctx if it is done before d passes
+func (p *RetryPolicy) wait(ctx context.Context, d time.Duration) error {
+	if p.sleep != nil {
+		return p.sleep(ctx, d)
+	}
+	return sleepContext(ctx, d)
+}
+
+// sleepContext waits for d to pass or for ctx to be done, returning the error of ctx in that case
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,127 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTestRetryPolicy(maxAttempts int) (*RetryPolicy, *[]time.Duration) {
+	var sleeps []time.Duration
+	policy := DefaultRetryPolicy()
+	policy.MaxAttempts = maxAttempts
+	policy.random = func() float64 { return 1 }
+	policy.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return nil
+	}
+	return policy, &sleeps
+}
+
+func TestRetryTransientStatusCode(t *testing.T) {
+	policy, sleeps := newTestRetryPolicy(4)
+	client := &MockClient{StatusCode: http.StatusServiceUnavailable, FailedRequests: 2}
+	twitterClient := HttpTwitterClient{Client: client, Retry: policy}
+	response, err := twitterClient.GetTweets(context.Background(), userId, tweetsPerResponse, sinceTweetId, "")
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if len(response.Tweets) != 10 {
+		t.Errorf("tweets = %d; expected = 10", len(response.Tweets))
+	}
+	expected := []time.Duration{time.Second, 2 * time.Second}
+	if len(*sleeps) != len(expected) || (*sleeps)[0] != expected[0] || (*sleeps)[1] != expected[1] {
+		t.Errorf("sleeps = %v; expected %v", *sleeps, expected)
+	}
+}
+
+func TestRetryNetworkErrorWhilePaging(t *testing.T) {
+	policy, _ := newTestRetryPolicy(2)
+	// the first page succeeds, then the connection drops once
+	client := &MockClient{}
+	twitterClient := HttpTwitterClient{Client: &flakyClient{client: client, failAt: 2}, Retry: policy}
+	response, err := twitterClient.GetTweets(context.Background(), userId, tweetsPerResponse, sinceTweetId, "")
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if len(response.Tweets) != 10 {
+		t.Errorf("tweets = %d; expected = 10", len(response.Tweets))
+	}
+}
+
+func TestRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	policy, sleeps := newTestRetryPolicy(3)
+	client := &MockClient{ReturnError: true}
+	twitterClient := HttpTwitterClient{Client: client, Retry: policy}
+	_, err := twitterClient.GetTweets(context.Background(), userId, tweetsPerResponse, sinceTweetId, "")
+	if err == nil {
+		t.Error("expected error to be present")
+	}
+	if client.requestNumber != 3 {
+		t.Errorf("requests = %d; expected = 3", client.requestNumber)
+	}
+	if len(*sleeps) != 2 {
+		t.Errorf("sleeps = %v; expected 2", *sleeps)
+	}
+}
+
+func TestRetryIgnoresPermanentFailures(t *testing.T) {
+	policy, _ := newTestRetryPolicy(4)
+	for _, client := range []*MockClient{{StatusCode: http.StatusNotFound}, {InvalidJson: true}} {
+		twitterClient := HttpTwitterClient{Client: client, Retry: policy}
+		_, err := twitterClient.GetTweets(context.Background(), userId, tweetsPerResponse, sinceTweetId, "")
+		if err == nil {
+			t.Error("expected error to be present")
+		}
+		if client.requestNumber != 1 {
+			t.Errorf("requests = %d; expected = 1", client.requestNumber)
+		}
+	}
+}
+
+func TestRetryBackoffIsCapped(t *testing.T) {
+	policy, _ := newTestRetryPolicy(10)
+	if backoff := policy.backoff(9); backoff != policy.MaxBackoff {
+		t.Errorf("backoff = %s; expected = %s", backoff, policy.MaxBackoff)
+	}
+	policy.random = func() float64 { return 0.5 }
+	if backoff := policy.backoff(2); backoff != time.Second {
+		t.Errorf("backoff = %s; expected = %s", backoff, time.Second)
+	}
+}
+
+// flakyClient fails the request numbered failAt as if the connection dropped
+type flakyClient struct {
+	client   HttpClient
+	failAt   int
+	requests int
+}
+
+func (c *flakyClient) Do(req *http.Request) (*http.Response, error) {
+	c.requests++
+	if c.requests == c.failAt {
+		return nil, errors.New("connection reset by peer")
+	}
+	return c.client.Do(req)
+}
+
+func TestRetryStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	policy, _ := newTestRetryPolicy(4)
+	policy.sleep = func(ctx context.Context, d time.Duration) error {
+		cancel()
+		return ctx.Err()
+	}
+	client := &MockClient{StatusCode: http.StatusServiceUnavailable}
+	twitterClient := HttpTwitterClient{Client: client, Retry: policy}
+	_, err := twitterClient.GetTweets(ctx, userId, tweetsPerResponse, sinceTweetId, "")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Error = %v; expected %v", err, context.Canceled)
+	}
+	if client.requestNumber != 1 {
+		t.Errorf("requests = %d; expected = 1", client.requestNumber)
+	}
+}
@@ -0,0 +1,53 @@
+package fetch
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"mrnakumar.com/poli/constants"
+	"time"
+)
+
+const serveLoggerId = "serve"
+
+// Serve
+// fetches the tweets of all users right away and then every interval, until stop is closed. Each run starts by
+// syncing f.Lists, so that the new members of the lists are fetched in the same run. Runs never overlap: a
+// run that takes longer than interval is followed immediately by the next one. When stop is closed during a run the
+// users already started are completed, including saving their tweets, and the others are left for the next start.
+// Once ctx is done the run in progress is cancelled as well and Serve returns.
+func (f *Fetcher) Serve(ctx context.Context, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			log.Info().Str(constants.LoggerId, serveLoggerId).Msg("stopped")
+			return
+		case <-ctx.Done():
+			log.Info().Str(constants.LoggerId, serveLoggerId).Msg("cancelled")
+			return
+		default:
+		}
+		start := time.Now()
+		f.syncLists(ctx)
+		err := f.getAllUserTweets(ctx, stop)
+		if err != nil {
+			log.Error().Str(constants.LoggerId, serveLoggerId).Err(err).Msg("run failed")
+		}
+		elapsed := time.Since(start)
+		if elapsed > interval {
+			log.Warn().Str(constants.LoggerId, serveLoggerId).Msgf("run took '%s', longer than the interval of '%s'", elapsed, interval)
+		} else {
+			log.Info().Str(constants.LoggerId, serveLoggerId).Msgf("run took '%s'", elapsed)
+		}
+		select {
+		case <-stop:
+			log.Info().Str(constants.LoggerId, serveLoggerId).Msg("stopped")
+			return
+		case <-ctx.Done():
+			log.Info().Str(constants.LoggerId, serveLoggerId).Msg("cancelled")
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServeRunsUntilStopped(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	stop := make(chan struct{})
+	client := &usersClient{onTweetsRequest: func() {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests == 3 {
+			close(stop)
+		}
+	}}
+	fetcher, store := newTestFetcher(client)
+	if err := fetcher.AddUser(context.Background(), "user"); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		fetcher.Serve(context.Background(), time.Millisecond, stop)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after stop")
+	}
+	if requests != 3 {
+		t.Errorf("runs = %d; expected = 3", requests)
+	}
+	// the run in progress when stopping is completed
+	if sinceId, _ := store.GetWaterMark(context.Background(), "id-user", tweetWaterMark); sinceId != "id-user-2" {
+		t.Errorf("since id = '%s'; expected = 'id-user-2'", sinceId)
+	}
+}
+
+func TestServeStopSkipsUsersNotStarted(t *testing.T) {
+	stop := make(chan struct{})
+	var once sync.Once
+	client := &usersClient{onTweetsRequest: func() { once.Do(func() { close(stop) }) }}
+	fetcher, store := newTestFetcher(client)
+	for i := 0; i < 5; i++ {
+		if err := fetcher.AddUser(context.Background(), fmt.Sprintf("user%d", i)); err != nil {
+			t.Fatalf("Error = %v; expected nil", err)
+		}
+	}
+	fetcher.Serve(context.Background(), time.Hour, stop)
+	if len(store.tweets) != 2 {
+		t.Errorf("stored tweets = %d; expected only those of the first user", len(store.tweets))
+	}
+}
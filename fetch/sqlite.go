@@ -0,0 +1,29 @@
+package fetch
+
+import (
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const driverSqlite = "sqlite3"
+
+// foreign keys are only enforced when asked for
+const sqliteOptions = "_fk=true&_busy_timeout=5000"
+
+// openSqlite
+// opens the SQLite database in fileName, creating the file if it does not exist yet. Use Migrate to create the tables.
+func openSqlite(fileName string) (*Database, error) {
+	separator := "?"
+	if strings.Contains(fileName, "?") {
+		separator = "&"
+	}
+	ds, err := openDatabase(driverSqlite, fileName+separator+sqliteOptions)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer, so share one connection rather than fail with 'database is locked'.
+	// This also keeps ':memory:' databases alive between statements.
+	ds.DB.SetMaxOpenConns(1)
+	return ds, nil
+}
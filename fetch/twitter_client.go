@@ -2,6 +2,7 @@ package fetch
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,11 +13,28 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const twitterClientLoggerId = "twitter_client"
-const userTweetsUrl = "https://api.twitter.com/2/users/:id/tweets"
-const userUrl = "https://api.twitter.com/2/users/by/username/:username?user.fields=profile_image_url"
+
+// DefaultBaseUrl is the api of twitter, used when no other base url is given
+const DefaultBaseUrl = "https://api.twitter.com"
+
+// userFields are the fields of the profile of a user kept by poli
+const userFields = "?user.fields=profile_image_url,description,location,url,verified,protected"
+
+// MaxUsersPerLookup is the most users twitter looks up by name in one request
+const MaxUsersPerLookup = 100
+
+// maxListMembersPerRequest is the most members of a list twitter returns in one page
+const maxListMembersPerRequest = 100
+
+const tweetFields = "id,text,lang,created_at,author_id,conversation_id,in_reply_to_user_id,referenced_tweets," +
+	"public_metrics,entities,possibly_sensitive"
+
+// a request refused for the rate limit is retried after the reset this many times at the most
+const maxRateLimitedAttempts = 3
 
 type TweetId = string
 type TwitterUserId = string
@@ -24,8 +42,20 @@ type TwitterUserName = string
 type StartTimeISO8601ZoneUTC = string
 
 type HttpTwitterClient struct {
-	Bearer string
-	Client HttpClient
+	// BaseUrl is DefaultBaseUrl if empty, a fake twitter server can be given for tests
+	BaseUrl string
+	Bearer  string
+	// Tokens replaces Bearer if not nil. A token twitter rejects with 401 is invalidated and the request is sent once
+	// more with a new one.
+	Tokens TokenSource
+	// Credentials replaces Bearer, Tokens and RateLimits if not nil, each credential has its own rate limits
+	Credentials *CredentialPool
+	Client      HttpClient
+	// RateLimits makes requests wait for the reset of an exhausted rate limit rather than fail.
+	// Rate limits are not tracked if it is nil.
+	RateLimits *RateLimiter
+	// Retry is the policy for transient failures. Nothing is retried if it is nil.
+	Retry *RetryPolicy
 }
 
 type HttpClient interface {
@@ -35,79 +65,198 @@ type HttpClient interface {
 // GetTweets
 // sinceId takes precedence over startTime. If both of these are missing then error is returned.
 // tweetsPerRequest must be between 5 and 100
-func (c HttpTwitterClient) GetTweets(userId TwitterUserId, tweetsPerRequest uint8, sinceId TweetId,
+func (c HttpTwitterClient) GetTweets(ctx context.Context, userId TwitterUserId, tweetsPerRequest uint8, sinceId TweetId,
 	startTime StartTimeISO8601ZoneUTC) (*TweetsResponse, error) {
-	url, err := tweetsUrl(userId, tweetsPerRequest, "", sinceId, startTime)
-	if err != nil {
+	query := TweetsQuery{SinceId: sinceId}
+	if len(strings.TrimSpace(sinceId)) == 0 {
+		query.StartTime = startTime
+	}
+	if err := checkTweetsPerRequest(tweetsPerRequest); err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(sinceId)) == 0 && len(strings.TrimSpace(startTime)) == 0 {
+		return nil, errors.New("start tweet id or time must be provided")
+	}
+	return c.QueryTweets(ctx, userId, tweetsPerRequest, query)
+}
+
+// GetTweetsBefore
+// returns the tweets older than untilId, or created before endTime if untilId is missing, going back to startTime
+// or as far as twitter allows if startTime is missing. Error is returned if both untilId and endTime are missing.
+// tweetsPerRequest must be between 5 and 100
+func (c HttpTwitterClient) GetTweetsBefore(ctx context.Context, userId TwitterUserId, tweetsPerRequest uint8, untilId TweetId,
+	endTime StartTimeISO8601ZoneUTC, startTime StartTimeISO8601ZoneUTC) (*TweetsResponse, error) {
+	query := TweetsQuery{UntilId: untilId, StartTime: startTime}
+	if len(strings.TrimSpace(untilId)) == 0 {
+		query.EndTime = endTime
+	}
+	if err := checkTweetsPerRequest(tweetsPerRequest); err != nil {
 		return nil, err
 	}
+	if len(strings.TrimSpace(untilId)) == 0 && len(strings.TrimSpace(endTime)) == 0 {
+		return nil, errors.New("end tweet id or time must be provided")
+	}
+	return c.QueryTweets(ctx, userId, tweetsPerRequest, query)
+}
 
+// QueryTweets
+// returns all the tweets of userId selected by query, reading as many pages as needed.
+// The newest and oldest ids in the Meta of the result are those of all the pages.
+func (c HttpTwitterClient) QueryTweets(ctx context.Context, userId TwitterUserId, tweetsPerRequest uint8, query TweetsQuery) (*TweetsResponse, error) {
 	result := &TweetsResponse{}
-	for {
-		var tweets TweetsResponse
-		err = getRequest(&c, url, &tweets)
-		if err == nil {
-			// process the response
-			existingNewestId := result.Meta.NewestId
-			result.Meta = tweets.Meta
-			if len(existingNewestId) > 0 {
-				// only update if from first fetch
-				result.Meta.NewestId = existingNewestId
-			}
-			if tweets.Tweets != nil {
-				if result.Tweets == nil {
-					result.Tweets = tweets.Tweets
-				} else {
-					for _, tweet := range tweets.Tweets {
-						result.Tweets = append(result.Tweets, tweet)
-					}
-				}
-			} else {
-				// strange no tweets are returned. meta has already been taken so just break out of loop
-				break
-			}
-			if tweets.Meta.NextToken == "" {
-				// not sufficient tweets. means end reached
-				log.Info().Str(constants.LoggerId, twitterClientLoggerId).Msgf("received '%d' tweets for userId '%s'.",
-					len(tweets.Tweets), userId)
-				break
-			}
-		} else {
-			// error encountered in getting the response from twitter
-			return nil, err
+	err := c.QueryTweetPages(ctx, userId, tweetsPerRequest, query, "", func(page *TweetsResponse) error {
+		existingNewestId := result.Meta.NewestId
+		result.Meta = page.Meta
+		if len(existingNewestId) > 0 {
+			// only update if from first fetch
+			result.Meta.NewestId = existingNewestId
 		}
-		url, _ = tweetsUrl(userId, tweetsPerRequest, result.Meta.NextToken, "", "")
+		result.Tweets = append(result.Tweets, page.Tweets...)
+		result.Errors = append(result.Errors, page.Errors...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	log.Info().Str(constants.LoggerId, twitterClientLoggerId).Msgf("returning a total of '%d' tweets for user id '%s'.",
 		len(result.Tweets), userId)
-	return result, err
+	return result, nil
+}
+
+// QueryTweetPages
+// calls onPage with each page of the tweets of userId selected by query, newest first, as soon as it is read.
+// Reading starts from the page of paginationToken, or from the first page if it is empty, and stops at the last page
+// or at the first error, including one returned by onPage. The Meta of each page is that of the page alone.
+func (c HttpTwitterClient) QueryTweetPages(ctx context.Context, userId TwitterUserId, tweetsPerRequest uint8, query TweetsQuery,
+	paginationToken string, onPage func(page *TweetsResponse) error) error {
+	for {
+		url, err := tweetsUrl(c.endpointUrl(EndpointUserTweets), userId, tweetsPerRequest, paginationToken, query)
+		if err != nil {
+			return err
+		}
+		var page TweetsResponse
+		err = getRequest(ctx, &c, EndpointUserTweets, url, &page)
+		if err != nil {
+			return err
+		}
+		if len(page.Tweets) == 0 && len(page.Errors) > 0 {
+			// nothing but errors, such as for a suspended user
+			return newTwitterError(http.StatusOK, url, page.Errors)
+		}
+		err = onPage(&page)
+		if err != nil {
+			return err
+		}
+		if page.Tweets == nil || page.Meta.NextToken == "" {
+			// no tweets are returned past the last page
+			log.Info().Str(constants.LoggerId, twitterClientLoggerId).Msgf("received '%d' tweets for userId '%s'.",
+				len(page.Tweets), userId)
+			return nil
+		}
+		paginationToken = page.Meta.NextToken
+	}
 }
 
 // FindUser
 // returns error if userName not found
-func (c HttpTwitterClient) FindUser(userName TwitterUserName) (*UserResponse, error) {
-	url := strings.ReplaceAll(userUrl, ":username", userName)
+func (c HttpTwitterClient) FindUser(ctx context.Context, userName TwitterUserName) (*UserResponse, error) {
+	url := strings.ReplaceAll(c.endpointUrl(EndpointUserByName), ":username", userName) + userFields
 	var response UserResponse
-	err := getRequest(&c, url, &response)
+	err := getRequest(ctx, &c, EndpointUserByName, url, &response)
 	if err != nil {
 		return nil, err
 	}
-	if response.Errors != nil {
-		return nil, errors.New(response.Errors[0].Title)
+	if len(response.Data.Id) == 0 && len(response.Errors) > 0 {
+		return nil, newTwitterError(http.StatusOK, url, response.Errors)
 	}
 	return &response, nil
 }
 
-func getRequest(c *HttpTwitterClient, url string, v interface{}) error {
-	req, err := http.NewRequest("GET", url, nil)
+// FindUsers
+// looks up to MaxUsersPerLookup users by name in one request. The users not found or suspended are in the errors of
+// the response rather than failing it.
+func (c HttpTwitterClient) FindUsers(ctx context.Context, userNames []TwitterUserName) (*UsersResponse, error) {
+	if len(userNames) == 0 || len(userNames) > MaxUsersPerLookup {
+		return nil, fmt.Errorf("userNames must be between 1 and %d, both inclusive", MaxUsersPerLookup)
+	}
+	url := c.endpointUrl(EndpointUsersByName) + userFields + "&usernames=" + strings.Join(userNames, ",")
+	var response UsersResponse
+	err := getRequest(ctx, &c, EndpointUsersByName, url, &response)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return &response, nil
+}
+
+// GetUserById
+// returns the current name and profile of the user with userId, which unlike the name never changes.
+func (c HttpTwitterClient) GetUserById(ctx context.Context, userId TwitterUserId) (*UserResponse, error) {
+	url := strings.ReplaceAll(c.endpointUrl(EndpointUserById), ":id", userId) + userFields
+	var response UserResponse
+	err := getRequest(ctx, &c, EndpointUserById, url, &response)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Data.Id) == 0 && len(response.Errors) > 0 {
+		return nil, newTwitterError(http.StatusOK, url, response.Errors)
+	}
+	return &response, nil
+}
+
+// GetListMembers
+// returns the page of the members of the list with listId from paginationToken, or the first page if it is empty.
+// Suspended users are not members as far as twitter tells.
+func (c HttpTwitterClient) GetListMembers(ctx context.Context, listId string, paginationToken string) (*ListMembersResponse, error) {
+	url := strings.ReplaceAll(c.endpointUrl(EndpointListMembers), ":id", listId) + userFields +
+		"&max_results=" + strconv.Itoa(maxListMembersPerRequest)
+	if len(paginationToken) > 0 {
+		url += "&pagination_token=" + paginationToken
 	}
-	addBearer(req, c.Bearer)
-	res, err := c.Client.Do(req)
+	var response ListMembersResponse
+	err := getRequest(ctx, &c, EndpointListMembers, url, &response)
 	if err != nil {
-		log.Error().Str(constants.LoggerId, twitterClientLoggerId).Err(err).Msgf("failed to get for url '%s'", url)
-		return fmt.Errorf("request failed for url '%s'", url)
+		return nil, err
+	}
+	if len(response.Data) == 0 && len(response.Errors) > 0 {
+		// the list does not exist or is private
+		return nil, newTwitterError(http.StatusOK, url, response.Errors)
+	}
+	return &response, nil
+}
+
+// transientError marks failures that may not happen again if the request is sent again
+type transientError struct {
+	error
+}
+
+func (e transientError) Unwrap() error {
+	return e.error
+}
+
+// getRequest
+// decodes the response for url into v, retrying transient failures as c.Retry allows. Nothing is retried once ctx is
+// done, nor a request a cassette has no response for.
+func getRequest(ctx context.Context, c *HttpTwitterClient, endpoint string, url string, v interface{}) error {
+	for attempt := 1; ; attempt++ {
+		err := getRequestOnce(ctx, c, endpoint, url, v)
+		var transient transientError
+		if err == nil || !errors.As(err, &transient) || errors.Is(err, ErrNotRecorded) || !c.Retry.allowsRetry(attempt) ||
+			ctx.Err() != nil {
+			return err
+		}
+		backoff := c.Retry.backoff(attempt)
+		log.Warn().Str(constants.LoggerId, twitterClientLoggerId).Err(err).
+			Msgf("attempt '%d' failed for url '%s', retrying in '%s'", attempt, url, backoff)
+		if waitErr := c.Retry.wait(ctx, backoff); waitErr != nil {
+			return fmt.Errorf("gave up retrying url '%s': %w", url, waitErr)
+		}
+	}
+}
+
+func getRequestOnce(ctx context.Context, c *HttpTwitterClient, endpoint string, url string, v interface{}) error {
+	res, err := doRateLimited(ctx, c, endpoint, url)
+	if err != nil {
+		return err
 	}
 	defer closeOrLogWarningIfFailed(res.Body)
 	if res.StatusCode != http.StatusOK {
@@ -117,44 +266,184 @@ func getRequest(c *HttpTwitterClient, url string, v interface{}) error {
 				Msgf("received status code '%d', message '%s' for url '%s'",
 					res.StatusCode, msg, url)
 		}
-		return fmt.Errorf("unknown status code '%d' for url '%s'", res.StatusCode, url)
+		var body problem
+		// the body is only for the details, the status code is enough without them
+		_ = json.Unmarshal(msg, &body)
+		apiErrors := body.Errors
+		if len(body.Title) > 0 {
+			apiErrors = append([]APIError{body.APIError}, apiErrors...)
+		}
+		err = newTwitterError(res.StatusCode, url, apiErrors)
+		if c.Retry.isRetryable(res.StatusCode) {
+			return transientError{err}
+		}
+		return err
 	}
 	bodyBytes, err := ioutil.ReadAll(res.Body)
-	if err == nil && len(bodyBytes) > 0 {
+	if err != nil {
+		return transientError{fmt.Errorf("failed to read response body for url '%s': %w: %v", url, ErrInvalidResponse, err)}
+	}
+	if len(bodyBytes) > 0 {
 		err = json.NewDecoder(bytes.NewBuffer(bodyBytes)).Decode(&v)
 		if err != nil {
-			log.Error().Str(constants.LoggerId, twitterClientLoggerId).Err(err)
-			return fmt.Errorf("failed to decode response body '%s' for url '%s'", string(bodyBytes), url)
+			log.Error().Str(constants.LoggerId, twitterClientLoggerId).Err(err).Msgf("failed to decode response for url '%s'", url)
+			return fmt.Errorf("failed to decode response body '%s' for url '%s': %w", string(bodyBytes), url, ErrInvalidResponse)
 		}
+		logPartialErrors(url, bodyBytes)
 		return nil
 	} else {
-		return fmt.Errorf("failed to read response body for url '%s'", url)
+		return fmt.Errorf("failed to read response body for url '%s': %w", url, ErrInvalidResponse)
+	}
+}
+
+// doRateLimited
+// sends a GET request for url, waiting for the rate limit of endpoint to reset when it is exhausted.
+func doRateLimited(ctx context.Context, c *HttpTwitterClient, endpoint string, url string) (*http.Response, error) {
+	if c.Credentials != nil {
+		return c.Credentials.do(ctx, c, endpoint, url)
+	}
+	for attempt := 1; ; attempt++ {
+		if c.RateLimits != nil {
+			if err := c.RateLimits.acquire(ctx, endpoint); err != nil {
+				return nil, fmt.Errorf("gave up waiting for the rate limit of '%s': %w", endpoint, err)
+			}
+		}
+		res, err := doAuthorized(ctx, c, url)
+		if err != nil {
+			return nil, err
+		}
+		if c.RateLimits == nil {
+			return res, nil
+		}
+		if res.StatusCode != http.StatusTooManyRequests || attempt == maxRateLimitedAttempts {
+			c.RateLimits.update(endpoint, res.Header)
+			return res, nil
+		}
+		log.Warn().Str(constants.LoggerId, twitterClientLoggerId).Msgf("rate limited for url '%s'", url)
+		c.RateLimits.exhausted(endpoint, res.Header)
+		closeOrLogWarningIfFailed(res.Body)
 	}
 }
 
-func tweetsUrl(userId TwitterUserId, tweetsPerRequest uint8, paginationToken string, sinceId TweetId,
-	startTime StartTimeISO8601ZoneUTC) (string, error) {
+// doAuthorized
+// sends a GET request for url with the bearer token. If twitter rejects a token of c.Tokens, it is sent once more with
+// a new token.
+func doAuthorized(ctx context.Context, c *HttpTwitterClient, url string) (*http.Response, error) {
+	for refreshed := false; ; refreshed = true {
+		bearer := c.Bearer
+		if c.Tokens != nil {
+			var err error
+			bearer, err = c.Tokens.Token(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get bearer token for url '%s': %w", url, err)
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		addBearer(req, bearer)
+		res, err := c.Client.Do(req)
+		if err != nil {
+			log.Error().Str(constants.LoggerId, twitterClientLoggerId).Err(err).Msgf("failed to get for url '%s'", url)
+			return nil, transientError{fmt.Errorf("request failed for url '%s': %w", url, err)}
+		}
+		if res.StatusCode != http.StatusUnauthorized || c.Tokens == nil || refreshed {
+			return res, nil
+		}
+		log.Warn().Str(constants.LoggerId, twitterClientLoggerId).Msgf("bearer token rejected for url '%s', refreshing it", url)
+		c.Tokens.Invalidate(bearer)
+		closeOrLogWarningIfFailed(res.Body)
+	}
+}
+
+// endpointUrl returns the url of endpoint on the base url of c
+func (c *HttpTwitterClient) endpointUrl(endpoint string) string {
+	return baseUrlOrDefault(c.BaseUrl) + endpoint
+}
+
+func baseUrlOrDefault(baseUrl string) string {
+	if len(baseUrl) == 0 {
+		return DefaultBaseUrl
+	}
+	return strings.TrimSuffix(baseUrl, "/")
+}
+
+// TweetsQuery
+// selects tweets of a timeline. All the bounds are optional and exclusive.
+type TweetsQuery struct {
+	SinceId   TweetId
+	UntilId   TweetId
+	StartTime StartTimeISO8601ZoneUTC
+	EndTime   StartTimeISO8601ZoneUTC
+}
+
+func checkTweetsPerRequest(tweetsPerRequest uint8) error {
 	if tweetsPerRequest < 5 || tweetsPerRequest > 100 {
-		return "", errors.New("tweetsPerRequest must be between 5 to 100, both inclusive")
+		return errors.New("tweetsPerRequest must be between 5 to 100, both inclusive")
+	}
+	return nil
+}
+
+func tweetsUrl(userTweetsUrl string, userId TwitterUserId, tweetsPerRequest uint8, paginationToken string, query TweetsQuery) (string, error) {
+	if err := checkTweetsPerRequest(tweetsPerRequest); err != nil {
+		return "", err
 	}
 	var tweetsUrl = strings.ReplaceAll(userTweetsUrl, ":id", userId)
 	var queryPart = "?max_results=" + strconv.FormatUint(uint64(tweetsPerRequest), 10)
 	if len(paginationToken) > 0 {
 		queryPart = queryPart + "&pagination_token=" + paginationToken
-	} else if len(strings.TrimSpace(sinceId)) > 0 {
-		queryPart = queryPart + "&since_id=" + sinceId
-	} else {
-		if len(strings.TrimSpace(startTime)) == 0 {
-			return "", errors.New("start tweet id or time must be provided")
-		}
-		if len(strings.TrimSpace(startTime)) > 0 {
-			queryPart = queryPart + "&start_time=" + startTime
+	}
+	// the bounds are repeated with the pagination token as they are not part of it
+	for _, parameter := range []struct {
+		name  string
+		value string
+	}{
+		{"since_id", query.SinceId},
+		{"until_id", query.UntilId},
+		{"start_time", query.StartTime},
+		{"end_time", query.EndTime},
+	} {
+		if len(strings.TrimSpace(parameter.value)) > 0 {
+			queryPart = queryPart + "&" + parameter.name + "=" + parameter.value
 		}
 	}
-	queryPart = queryPart + "&tweet.fields=id,text,lang"
+	queryPart = queryPart + "&tweet.fields=" + tweetFields
 	return tweetsUrl + queryPart, nil
 }
 
+// isOlder returns whether the tweet with id a was created before the one with id b.
+// Tweet ids are numbers that grow with time.
+func isOlder(a TweetId, b TweetId) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// logPartialErrors
+// logs each of the errors returned with a successful response, whatever the endpoint. They are left to the caller to
+// handle.
+func logPartialErrors(url string, body []byte) {
+	var partial struct {
+		Errors []APIError `json:"errors"`
+	}
+	if json.Unmarshal(body, &partial) != nil {
+		return
+	}
+	for _, apiError := range partial.Errors {
+		log.Warn().Str(constants.LoggerId, twitterClientLoggerId).
+			Str("title", apiError.Title).
+			Str("detail", apiError.Detail).
+			Str("type", apiError.Type).
+			Str("resource_type", apiError.ResourceType).
+			Str("resource_id", apiError.ResourceId).
+			Str("parameter", apiError.Parameter).
+			Str("url", url).
+			Msg("twitter returned an error with the response")
+	}
+}
+
 func addBearer(req *http.Request, bearer string) {
 	req.Header.Add("Authorization", "Bearer "+bearer)
 }
@@ -172,28 +461,104 @@ type UserInfo struct {
 type TweetsResponse struct {
 	Tweets []Tweet `json:"data"`
 	Meta   Meta    `json:"meta"`
+	// Errors are returned along with the tweets for the parts of the request that failed
+	Errors []APIError `json:"errors"`
 }
 
 type Tweet struct {
-	Id   string `json:"id"`
-	Text string `json:"text"`
-	Lang string `json:"lang"`
+	Id                string            `json:"id"`
+	Text              string            `json:"text"`
+	Lang              string            `json:"lang"`
+	CreatedAt         time.Time         `json:"created_at"`
+	AuthorId          TwitterUserId     `json:"author_id"`
+	ConversationId    TweetId           `json:"conversation_id"`
+	InReplyToUserId   TwitterUserId     `json:"in_reply_to_user_id"`
+	ReferencedTweets  []ReferencedTweet `json:"referenced_tweets"`
+	PublicMetrics     *PublicMetrics    `json:"public_metrics"`
+	Entities          *Entities         `json:"entities"`
+	PossiblySensitive bool              `json:"possibly_sensitive"`
+}
+
+type ReferencedTweet struct {
+	// Type is one of 'retweeted', 'quoted' or 'replied_to'
+	Type string  `json:"type"`
+	Id   TweetId `json:"id"`
+}
+
+type PublicMetrics struct {
+	RetweetCount int `json:"retweet_count"`
+	ReplyCount   int `json:"reply_count"`
+	LikeCount    int `json:"like_count"`
+	QuoteCount   int `json:"quote_count"`
+}
+
+type Entities struct {
+	Hashtags []TagEntity     `json:"hashtags"`
+	Cashtags []TagEntity     `json:"cashtags"`
+	Mentions []MentionEntity `json:"mentions"`
+	Urls     []UrlEntity     `json:"urls"`
+}
+
+// Entity
+// is the position of an entity in the text of a tweet. End is exclusive.
+type Entity struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+type TagEntity struct {
+	Entity
+	Tag string `json:"tag"`
+}
+
+type MentionEntity struct {
+	Entity
+	UserName TwitterUserName `json:"username"`
+	Id       TwitterUserId   `json:"id"`
+}
+
+type UrlEntity struct {
+	Entity
+	Url         string `json:"url"`
+	ExpandedUrl string `json:"expanded_url"`
+	DisplayUrl  string `json:"display_url"`
 }
 
 type Meta struct {
 	NewestId    string `json:"newest_id"`
+	OldestId    string `json:"oldest_id"`
 	NextToken   string `json:"next_token"`
 	ResultCount uint8  `json:"result_count"`
 }
 
+type UserData struct {
+	Id              string `json:"id"`
+	Name            string `json:"name"`
+	UserName        string `json:"username"`
+	ProfileImageUrl string `json:"profile_image_url"`
+	Description     string `json:"description"`
+	Location        string `json:"location"`
+	Url             string `json:"url"`
+	Verified        bool   `json:"verified"`
+	Protected       bool   `json:"protected"`
+}
+
 type UserResponse struct {
-	Data struct {
-		Id              string `json:"id"`
-		Name            string `json:"name"`
-		UserName        string `json:"username"`
-		ProfileImageUrl string `json:"profile_image_url"`
-	}
-	Errors []struct {
-		Title string
-	}
+	Data   UserData   `json:"data"`
+	Errors []APIError `json:"errors"`
+}
+
+// UsersResponse
+// is the response of a batch lookup. Errors has an entry for each user that is not returned.
+type UsersResponse struct {
+	Data   []UserData `json:"data"`
+	Errors []APIError `json:"errors"`
+}
+
+// ListMembersResponse
+// is a page of the members of a list.
+type ListMembersResponse struct {
+	Data   []UserData `json:"data"`
+	Meta   Meta       `json:"meta"`
+	Errors []APIError `json:"errors"`
 }
@@ -2,19 +2,24 @@ package fetch
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"strings"
 	"testing"
+	"time"
 )
 import "net/http"
 
 type MockClient struct {
-	InvalidJson   bool
-	ReturnError   bool
-	StatusCode    int
-	requestNumber uint8
+	InvalidJson bool
+	ReturnError bool
+	StatusCode  int
+	// FailedRequests limits ReturnError and StatusCode to the given number of first requests if not 0
+	FailedRequests uint8
+	requestNumber  uint8
+	pageNumber     uint8
 }
 
 const tweetsPerResponse = 5
@@ -124,18 +129,26 @@ func (c *MockClient) Do(req *http.Request) (*http.Response, error) {
 
 func handleGetTweetsRequest(c *MockClient) (*http.Response, error) {
 	c.requestNumber++
-	if c.ReturnError {
+	failing := c.FailedRequests == 0 || c.requestNumber <= c.FailedRequests
+	if c.ReturnError && failing {
 		return nil, errors.New("network error")
 	}
+	if c.StatusCode > 0 && failing {
+		return &http.Response{
+			StatusCode: c.StatusCode,
+			Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"title": "failed"}`))),
+		}, nil
+	}
+	c.pageNumber++
 	var bodyText string
 	if c.InvalidJson {
 		bodyText = "." + tweetsResponseBody1
-	} else if c.requestNumber == 1 {
+	} else if c.pageNumber == 1 {
 		bodyText = tweetsResponseBody1
-	} else if c.requestNumber == 2 {
+	} else if c.pageNumber == 2 {
 		bodyText = tweetsResponseBody2
 	} else {
-		return nil, errors.New("only two requests are supported by this test client")
+		return nil, errors.New("only two pages are supported by this test client")
 	}
 	body := []byte(bodyText)
 	r := ioutil.NopCloser(bytes.NewReader(body))
@@ -143,9 +156,6 @@ func handleGetTweetsRequest(c *MockClient) (*http.Response, error) {
 		StatusCode: http.StatusOK,
 		Body:       r,
 	}
-	if c.StatusCode > 0 {
-		response.StatusCode = c.StatusCode
-	}
 	return response, nil
 }
 
@@ -169,7 +179,7 @@ func TestGetTweets(t *testing.T) {
 		Bearer: "",
 		Client: &MockClient{},
 	}
-	response, err := twitterClient.GetTweets("37365807", tweetsPerResponse, sinceTweetId, "")
+	response, err := twitterClient.GetTweets(context.Background(), "37365807", tweetsPerResponse, sinceTweetId, "")
 	if err != nil {
 		t.Errorf("Error = %v; expected nil", err)
 	}
@@ -186,12 +196,32 @@ func TestGetTweets(t *testing.T) {
 	}
 }
 
+func TestQueryTweetPagesStopsOnPageError(t *testing.T) {
+	client := &MockClient{}
+	twitterClient := HttpTwitterClient{Client: client}
+	pages := 0
+	err := twitterClient.QueryTweetPages(context.Background(), userId, tweetsPerResponse, TweetsQuery{SinceId: sinceTweetId}, "",
+		func(page *TweetsResponse) error {
+			pages++
+			if len(page.Tweets) != tweetsPerResponse {
+				t.Errorf("tweets = %d; expected = %d", len(page.Tweets), tweetsPerResponse)
+			}
+			return errors.New("failed to store page")
+		})
+	if err == nil {
+		t.Error("expected error to be present")
+	}
+	if pages != 1 || client.requestNumber != 1 {
+		t.Errorf("pages = %d, requests = %d; expected 1 of each", pages, client.requestNumber)
+	}
+}
+
 func TestGetTweetsInvalidJson(t *testing.T) {
 	twitterClient := HttpTwitterClient{
 		Bearer: "",
 		Client: &MockClient{InvalidJson: true},
 	}
-	_, err := twitterClient.GetTweets("37365807", tweetsPerResponse, sinceTweetId, "")
+	_, err := twitterClient.GetTweets(context.Background(), "37365807", tweetsPerResponse, sinceTweetId, "")
 	if err == nil {
 		t.Error("expected error to be present")
 	}
@@ -202,7 +232,7 @@ func TestGetTweetsClientError(t *testing.T) {
 		Bearer: "",
 		Client: &MockClient{ReturnError: true},
 	}
-	_, err := twitterClient.GetTweets("37365807", tweetsPerResponse, sinceTweetId, "")
+	_, err := twitterClient.GetTweets(context.Background(), "37365807", tweetsPerResponse, sinceTweetId, "")
 	if err == nil {
 		t.Error("expected error to be present")
 	}
@@ -213,7 +243,7 @@ func TestGetTweetsBothSinceIdAndSinceTimeMissing(t *testing.T) {
 		Bearer: "",
 		Client: &MockClient{},
 	}
-	_, err := twitterClient.GetTweets("37365807", tweetsPerResponse, "", "")
+	_, err := twitterClient.GetTweets(context.Background(), "37365807", tweetsPerResponse, "", "")
 	expectedError := "start tweet id or time must be provided"
 	if strings.Compare(err.Error(), expectedError) != 0 {
 		t.Errorf("expected error '%s'", expectedError)
@@ -225,7 +255,7 @@ func TestGetTweetsInvalidTweetsPerResponse(t *testing.T) {
 		Bearer: "",
 		Client: &MockClient{},
 	}
-	_, err := twitterClient.GetTweets("37365807", 4, "", "")
+	_, err := twitterClient.GetTweets(context.Background(), "37365807", 4, "", "")
 	expectedError := "tweetsPerRequest must be between 5 to 100, both inclusive"
 	if strings.Compare(err.Error(), expectedError) != 0 {
 		t.Errorf("expected error '%s'", expectedError)
@@ -238,14 +268,17 @@ func TestGetTweetsHttpStatusNotOk(t *testing.T) {
 		Bearer: "",
 		Client: &MockClient{StatusCode: errorCode},
 	}
-	_, err := twitterClient.GetTweets("37365807", tweetsPerResponse, sinceTweetId, "")
+	_, err := twitterClient.GetTweets(context.Background(), "37365807", tweetsPerResponse, sinceTweetId, "")
 	if err == nil {
 		t.Error("expected error to be present")
 	}
-	expected := fmt.Sprintf("unknown status code '%d'", errorCode)
+	expected := fmt.Sprintf("status code '%d'", errorCode)
 	if !strings.Contains(err.Error(), expected) {
 		t.Errorf("error = '%s'; expected to contain: '%s'", err.Error(), expected)
 	}
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Error = %v; expected %v", err, ErrNotFound)
+	}
 }
 
 func TestFindUser(t *testing.T) {
@@ -253,7 +286,7 @@ func TestFindUser(t *testing.T) {
 		Bearer: "",
 		Client: &MockClient{},
 	}
-	response, err := twitterClient.FindUser(userName)
+	response, err := twitterClient.FindUser(context.Background(), userName)
 	if err != nil {
 		t.Errorf("not expected error '%s'", err.Error())
 	}
@@ -270,8 +303,121 @@ func TestFindUserDoestNotExist(t *testing.T) {
 		Bearer: "",
 		Client: &MockClient{},
 	}
-	_, err := twitterClient.FindUser("not_a_user")
-	if err == nil {
-		t.Error("expected error; found none")
+	_, err := twitterClient.FindUser(context.Background(), "not_a_user")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Error = %v; expected %v", err, ErrNotFound)
+	}
+	var twitterError *TwitterError
+	if !errors.As(err, &twitterError) || len(twitterError.Errors) != 1 ||
+		twitterError.Errors[0].Detail != "Could not find user with username: [Profdilipmanda]." {
+		t.Errorf("Error = %#v; expected the details of the api error", err)
+	}
+}
+
+const detailedTweetsResponseBody = `{
+    "data": [
+        {
+            "id": "1445880548472328192",
+            "text": "RT @TwitterDev: Try #TwitterAPI today https://t.co/abc",
+            "lang": "en",
+            "created_at": "2021-10-06T23:02:04.000Z",
+            "author_id": "2244994945",
+            "conversation_id": "1445880548472328192",
+            "in_reply_to_user_id": "783214",
+            "possibly_sensitive": true,
+            "referenced_tweets": [{"type": "retweeted", "id": "1445078208190291973"}],
+            "public_metrics": {"retweet_count": 11, "reply_count": 2, "like_count": 40, "quote_count": 1},
+            "entities": {
+                "hashtags": [{"start": 20, "end": 31, "tag": "TwitterAPI"}],
+                "mentions": [{"start": 3, "end": 14, "username": "TwitterDev", "id": "2244994945"}],
+                "urls": [{"start": 38, "end": 61, "url": "https://t.co/abc", "expanded_url": "https://developer.twitter.com", "display_url": "developer.twitter.com"}]
+            }
+        }
+    ],
+    "meta": {"newest_id": "1445880548472328192", "result_count": 1}
+}`
+
+// bodyClient answers every request with body
+type bodyClient struct {
+	body string
+	urls []string
+}
+
+func (c *bodyClient) Do(req *http.Request) (*http.Response, error) {
+	c.urls = append(c.urls, req.URL.String())
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(c.body))}, nil
+}
+
+func TestGetTweetsDecodesDetails(t *testing.T) {
+	client := &bodyClient{body: detailedTweetsResponseBody}
+	twitterClient := HttpTwitterClient{Client: client}
+	response, err := twitterClient.GetTweets(context.Background(), "2244994945", tweetsPerResponse, sinceTweetId, "")
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if !strings.Contains(client.urls[0], "tweet.fields="+tweetFields) {
+		t.Errorf("url = '%s'; expected to request '%s'", client.urls[0], tweetFields)
+	}
+	tweet := response.Tweets[0]
+	if tweet.CreatedAt.Format(time.RFC3339) != "2021-10-06T23:02:04Z" || tweet.AuthorId != "2244994945" ||
+		tweet.ConversationId != "1445880548472328192" || tweet.InReplyToUserId != "783214" || !tweet.PossiblySensitive {
+		t.Errorf("tweet = %+v; expected all the details", tweet)
+	}
+	if len(tweet.ReferencedTweets) != 1 || tweet.ReferencedTweets[0].Type != "retweeted" {
+		t.Errorf("referenced tweets = %+v; expected one retweet", tweet.ReferencedTweets)
+	}
+	if tweet.PublicMetrics == nil || tweet.PublicMetrics.LikeCount != 40 || tweet.PublicMetrics.RetweetCount != 11 {
+		t.Errorf("public metrics = %+v; expected 40 likes and 11 retweets", tweet.PublicMetrics)
+	}
+	entities := tweet.Entities
+	if entities == nil || len(entities.Hashtags) != 1 || entities.Hashtags[0].Tag != "TwitterAPI" ||
+		len(entities.Mentions) != 1 || entities.Mentions[0].Start != 3 || len(entities.Urls) != 1 {
+		t.Errorf("entities = %+v; expected a hashtag, a mention and a url", entities)
+	}
+}
+
+const partialTweetsResponseBody = `{
+    "data": [
+        {"id": "1001", "text": "one", "lang": "en"}
+    ],
+    "errors": [
+        {
+            "value": "999",
+            "detail": "Could not find tweet with referenced_tweets.id: [999].",
+            "title": "Not Found Error",
+            "resource_type": "tweet",
+            "parameter": "referenced_tweets.id",
+            "resource_id": "999",
+            "type": "https://api.twitter.com/2/problems/resource-not-found"
+        }
+    ],
+    "meta": {"newest_id": "1001", "oldest_id": "1001", "result_count": 1}
+}`
+
+func TestGetTweetsKeepsPartialErrors(t *testing.T) {
+	twitterClient := HttpTwitterClient{Client: &bodyClient{body: partialTweetsResponseBody}}
+	response, err := twitterClient.GetTweets(context.Background(), userId, tweetsPerResponse, sinceTweetId, "")
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if len(response.Tweets) != 1 {
+		t.Errorf("tweets = %d; expected = 1", len(response.Tweets))
+	}
+	expected := APIError{Title: "Not Found Error", Detail: "Could not find tweet with referenced_tweets.id: [999].",
+		Type: problemResourceNotFound, ResourceType: "tweet", ResourceId: "999", Parameter: "referenced_tweets.id",
+		Value: "999"}
+	if len(response.Errors) != 1 || response.Errors[0] != expected {
+		t.Errorf("errors = %+v; expected [%+v]", response.Errors, expected)
+	}
+}
+
+func TestGetTweetsOnlyErrors(t *testing.T) {
+	body := `{"errors": [{"detail": "User has been suspended: [37365807].", "title": "Forbidden",
+		"resource_type": "user", "parameter": "id", "resource_id": "37365807",
+		"type": "https://api.twitter.com/2/problems/resource-not-found"}]}`
+	twitterClient := HttpTwitterClient{Client: &bodyClient{body: body}}
+	_, err := twitterClient.GetTweets(context.Background(), userId, tweetsPerResponse, sinceTweetId, "")
+	if !errors.Is(err, ErrSuspended) {
+		t.Errorf("Error = %v; expected %v", err, ErrSuspended)
 	}
 }
@@ -0,0 +1,105 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+var errInjected = errors.New("injected failure")
+
+// faultyStore
+// fails the transactions it begins at one step, to check that nothing of a failed transaction is kept.
+type faultyStore struct {
+	Store
+	failAt string
+}
+
+func (s *faultyStore) Begin(ctx context.Context) (Tx, error) {
+	if s.failAt == "begin" {
+		return nil, errInjected
+	}
+	txn, err := s.Store.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyTx{Tx: txn, failAt: s.failAt}, nil
+}
+
+type faultyTx struct {
+	Tx
+	failAt string
+}
+
+func (t *faultyTx) SaveTweets(ctx context.Context, userId TwitterUserId, tweets []Tweet) (SaveResult, error) {
+	if t.failAt == "save" {
+		return SaveResult{}, errInjected
+	}
+	return t.Tx.SaveTweets(ctx, userId, tweets)
+}
+
+func (t *faultyTx) UpdateWaterMark(ctx context.Context, userId TwitterUserId, kind WaterMarkType, waterMark string) error {
+	if t.failAt == "checkpoint" {
+		return errInjected
+	}
+	return t.Tx.UpdateWaterMark(ctx, userId, kind, waterMark)
+}
+
+// Commit fails after the tweets and checkpoint are written, as a lost connection would
+func (t *faultyTx) Commit() error {
+	if t.failAt == "commit" {
+		_ = t.Tx.Rollback()
+		return errInjected
+	}
+	return t.Tx.Commit()
+}
+
+func TestGetUserTweetsFailureKeepsNothing(t *testing.T) {
+	stores := map[string]func(t *testing.T) (Store, func() int){
+		"memory": func(t *testing.T) (Store, func() int) {
+			store := NewMemoryStore()
+			return store, func() int { return len(store.tweets) }
+		},
+		"sqlite": func(t *testing.T) (Store, func() int) {
+			ds := newSqliteStore(t)
+			return ds, func() int { return countTweets(t, ds) }
+		},
+	}
+	for name, newStore := range stores {
+		for _, failAt := range []string{"begin", "save", "checkpoint", "commit"} {
+			t.Run(name+"/"+failAt, func(t *testing.T) {
+				store, count := newStore(t)
+				fetcher := &Fetcher{
+					TwitterClient: HttpTwitterClient{Client: &MockClient{}},
+					Store:         &faultyStore{Store: store, failAt: failAt},
+				}
+				if err := fetcher.AddUser(context.Background(), userName); err != nil {
+					t.Fatalf("Error = %v; expected nil", err)
+				}
+				err := fetcher.GetUserTweets(context.Background(), userName)
+				if !errors.Is(err, errInjected) {
+					t.Fatalf("Error = %v; expected %v", err, errInjected)
+				}
+				if stored := count(); stored != 0 {
+					t.Errorf("stored tweets = %d; expected = 0", stored)
+				}
+				if sinceId, _ := store.GetWaterMark(context.Background(), userId, tweetWaterMark); sinceId != "" {
+					t.Errorf("since id = %s; expected none", sinceId)
+				}
+
+				// the next run reads the same tweets again and stores each of them once
+				fetcher.TwitterClient = HttpTwitterClient{Client: &MockClient{}}
+				fetcher.Store = store
+				if err = fetcher.GetUserTweets(context.Background(), userName); err != nil {
+					t.Fatalf("Error = %v; expected nil", err)
+				}
+				if stored := count(); stored != 10 {
+					t.Errorf("stored tweets = %d; expected = 10", stored)
+				}
+				if sinceId, _ := store.GetWaterMark(context.Background(), userId, tweetWaterMark); sinceId != "1301573587187331075" {
+					t.Errorf("since id = %s; expected = '1301573587187331075'", sinceId)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"mrnakumar.com/poli/constants"
+	"strconv"
+	"time"
+)
+
+// RemoveUser
+// stops tracking userName, removing their tweets and checkpoints as well.
+func (f *Fetcher) RemoveUser(ctx context.Context, userName string) error {
+	user, err := f.findUser(ctx, userName)
+	if err != nil {
+		return err
+	}
+	return f.Store.RemoveUser(ctx, user.Id)
+}
+
+// RefreshUsers
+// updates the name and profile of userName, or of all the users if userName is empty, from twitter, and records what
+// changed in the profile history. Users are looked up by id, so that those who changed their name are found.
+func (f *Fetcher) RefreshUsers(ctx context.Context, userName string) error {
+	var users []*User
+	if len(userName) > 0 {
+		user, err := f.findUser(ctx, userName)
+		if err != nil {
+			return err
+		}
+		users = append(users, user)
+	} else {
+		var err error
+		users, err = f.Store.GetAllUsers(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	failures := make(UserErrors)
+	for _, user := range users {
+		err := f.refreshUser(ctx, user)
+		if err != nil {
+			logUserFailure(user, err)
+			failures[user.Name] = err
+			if stopsRun(err) {
+				break
+			}
+		}
+	}
+	if len(failures) > 0 {
+		return failures
+	}
+	return nil
+}
+
+func (f *Fetcher) refreshUser(ctx context.Context, user *User) error {
+	response, err := f.TwitterClient.GetUserById(ctx, user.Id)
+	if err != nil {
+		return err
+	}
+	refreshed := newUser(response.Data)
+	if *refreshed == *user {
+		return nil
+	}
+	changes := profileChanges(user, refreshed, time.Now().UTC())
+	if refreshed.Name != user.Name {
+		log.Info().Str(constants.LoggerId, fetcherLoggerId).Msgf("user '%s' is now called '%s'", user.Name, refreshed.Name)
+	}
+	return f.Store.UpdateUser(ctx, refreshed, changes)
+}
+
+// GetProfileHistory
+// returns the changes to the profile of userName found by RefreshUsers, oldest first.
+func (f *Fetcher) GetProfileHistory(ctx context.Context, userName string) ([]*ProfileChange, error) {
+	user, err := f.findUser(ctx, userName)
+	if err != nil {
+		return nil, err
+	}
+	return f.Store.GetProfileHistory(ctx, user.Id)
+}
+
+// profileFields are the fields of a User kept in the profile history, by the name of the field of twitter. Those of
+// the full profile were not stored for the users tracked before it was read.
+var profileFields = []struct {
+	name        string
+	fullProfile bool
+	value       func(user *User) string
+}{
+	{"username", false, func(user *User) string { return user.Name }},
+	{"name", true, func(user *User) string { return user.DisplayName }},
+	{"description", true, func(user *User) string { return user.Description }},
+	{"location", true, func(user *User) string { return user.Location }},
+	{"url", true, func(user *User) string { return user.Url }},
+	{"profile_image_url", false, func(user *User) string { return user.ProfilePictureUrl }},
+	{"verified", true, func(user *User) string { return strconv.FormatBool(user.Verified) }},
+	{"protected", true, func(user *User) string { return strconv.FormatBool(user.Protected) }},
+}
+
+// profileChanges
+// returns a change at changedAt for each of the profileFields that differ between old and current. The fields of the
+// full profile of old are left out if they were never stored, as their values were unknown rather than changed.
+func profileChanges(old *User, current *User, changedAt time.Time) []ProfileChange {
+	var changes []ProfileChange
+	for _, field := range profileFields {
+		if field.fullProfile && !hasFullProfile(old) {
+			continue
+		}
+		oldValue, newValue := field.value(old), field.value(current)
+		if oldValue != newValue {
+			changes = append(changes, ProfileChange{UserId: current.Id, Field: field.name, OldValue: oldValue,
+				NewValue: newValue, ChangedAt: changedAt})
+		}
+	}
+	return changes
+}
+
+// hasFullProfile returns whether the full profile of user was stored. Twitter requires a display name, so it is only
+// empty for the users tracked before the full profile was read.
+func hasFullProfile(user *User) bool {
+	return len(user.DisplayName) > 0
+}
+
+// newUser returns the User with the profile in data
+func newUser(data UserData) *User {
+	return &User{
+		Id:                data.Id,
+		Name:              data.UserName,
+		ProfilePictureUrl: data.ProfileImageUrl,
+		DisplayName:       data.Name,
+		Description:       data.Description,
+		Location:          data.Location,
+		Url:               data.Url,
+		Verified:          data.Verified,
+		Protected:         data.Protected,
+	}
+}
+
+// findUser fails if userName is not tracked
+func (f *Fetcher) findUser(ctx context.Context, userName string) (*User, error) {
+	user, err := f.Store.GetUserIgnoringCase(ctx, userName)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("not found user '%s': %w", userName, ErrUserNotTracked)
+	}
+	return user, nil
+}
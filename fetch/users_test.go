@@ -0,0 +1,167 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mrnakumar.com/poli/faketwitter"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const renamedUser = `{"data": {"id": "37365807", "name": "Dilip Manal", "username": "renamed", "profile_image_url": "https://pbs.twimg.com/renamed.jpg"}}`
+
+// newFetcherWithTweets returns a Fetcher on a MemoryStore that has the tweets of userName
+func newFetcherWithTweets(t *testing.T) (*Fetcher, *MemoryStore) {
+	store := NewMemoryStore()
+	fetcher := &Fetcher{TwitterClient: HttpTwitterClient{Client: &MockClient{}}, Store: store}
+	if err := fetcher.AddUser(context.Background(), userName); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if err := fetcher.GetUserTweets(context.Background(), userName); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	return fetcher, store
+}
+
+func TestRemoveUser(t *testing.T) {
+	fetcher, store := newFetcherWithTweets(t)
+	if err := fetcher.RemoveUser(context.Background(), userName); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if found, _ := store.GetUserIgnoringCase(context.Background(), userName); found != nil {
+		t.Errorf("user = %v; expected nil", found)
+	}
+	if len(store.tweets) != 0 {
+		t.Errorf("stored tweets = %d; expected = 0", len(store.tweets))
+	}
+	if sinceId, _ := store.GetWaterMark(context.Background(), userId, tweetWaterMark); sinceId != "" {
+		t.Errorf("since id = %s; expected none", sinceId)
+	}
+	if err := fetcher.RemoveUser(context.Background(), userName); !errors.Is(err, ErrUserNotTracked) {
+		t.Errorf("Error = %v; expected %v", err, ErrUserNotTracked)
+	}
+}
+
+func TestRefreshUsersFindsRenamedUser(t *testing.T) {
+	fetcher, store := newFetcherWithTweets(t)
+	fetcher.TwitterClient = HttpTwitterClient{Client: statusClient{statusCode: http.StatusOK, body: renamedUser}}
+	if err := fetcher.RefreshUsers(context.Background(), ""); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	refreshed, _ := store.GetUser(context.Background(), "renamed")
+	if refreshed == nil || refreshed.Id != userId || refreshed.ProfilePictureUrl != "https://pbs.twimg.com/renamed.jpg" {
+		t.Errorf("user = %v; expected renamed user with id %s", refreshed, userId)
+	}
+	if len(store.tweets) != 10 {
+		t.Errorf("stored tweets = %d; expected = 10", len(store.tweets))
+	}
+}
+
+func TestRefreshUsersFailure(t *testing.T) {
+	fetcher, _ := newFetcherWithTweets(t)
+	fetcher.TwitterClient = HttpTwitterClient{Client: statusClient{statusCode: http.StatusUnauthorized}}
+	err := fetcher.RefreshUsers(context.Background(), userName)
+	if _, ok := err.(UserErrors); !ok {
+		t.Fatalf("Error = %v; expected UserErrors", err)
+	}
+	if !err.(UserErrors).Is(ErrUnauthorized) {
+		t.Errorf("Error = %v; expected %v", err, ErrUnauthorized)
+	}
+}
+
+func TestResetWaterMarks(t *testing.T) {
+	fetcher, _ := newFetcherWithTweets(t)
+	waterMarks, err := fetcher.GetWaterMarks(context.Background(), userName)
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if waterMarks[tweetWaterMark] != "1301573587187331075" {
+		t.Errorf("since id = %s; expected = '1301573587187331075'", waterMarks[tweetWaterMark])
+	}
+	if err = fetcher.ResetWaterMarks(context.Background(), userName, []WaterMarkType{"unknown"}); err == nil {
+		t.Errorf("Error = nil; expected unknown checkpoint kind")
+	}
+	if err = fetcher.ResetWaterMarks(context.Background(), userName, nil); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	waterMarks, _ = fetcher.GetWaterMarks(context.Background(), userName)
+	if len(waterMarks) != 0 {
+		t.Errorf("checkpoints = %v; expected none", waterMarks)
+	}
+}
+
+func TestRefreshUsersRecordsProfileHistory(t *testing.T) {
+	server, fetcher, store := newFakeTwitter(t, 0)
+	server.AddUser(faketwitter.User{Id: fakeUserId, Name: "Poli User", UserName: fakeUserName, Description: "MP"})
+	if err := fetcher.AddUser(context.Background(), fakeUserName); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if err := fetcher.RefreshUsers(context.Background(), ""); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if changes, _ := store.GetProfileHistory(context.Background(), fakeUserId); len(changes) != 0 {
+		t.Errorf("changes = %d; expected none as the profile is the same", len(changes))
+	}
+
+	server.AddUser(faketwitter.User{Id: fakeUserId, Name: "Poli User", UserName: "poli_minister", Description: "Minister",
+		Verified: true})
+	if err := fetcher.RefreshUsers(context.Background(), fakeUserName); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	user, _ := store.GetUser(context.Background(), "poli_minister")
+	if user == nil || user.Description != "Minister" || !user.Verified || user.DisplayName != "Poli User" {
+		t.Errorf("user = %+v; expected refreshed profile", user)
+	}
+	changes, err := fetcher.GetProfileHistory(context.Background(), "poli_minister")
+	if err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	var fields []string
+	for _, change := range changes {
+		fields = append(fields, fmt.Sprintf("%s:%s->%s", change.Field, change.OldValue, change.NewValue))
+		if change.ChangedAt.IsZero() {
+			t.Errorf("change = %+v; expected the time of the refresh", change)
+		}
+	}
+	expected := []string{"description:MP->Minister", "username:poli_user->poli_minister", "verified:false->true"}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("changes = %v; expected = %v", fields, expected)
+	}
+}
+
+func TestRefreshUsersFillsProfileWithoutHistory(t *testing.T) {
+	server, fetcher, store := newFakeTwitter(t, 0)
+	// tracked before the full profile was read
+	if err := store.AddUser(context.Background(), &User{Id: fakeUserId, Name: fakeUserName}); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	server.AddUser(faketwitter.User{Id: fakeUserId, Name: "Poli User", UserName: "poli_minister", Description: "MP",
+		Verified: true})
+	if err := fetcher.RefreshUsers(context.Background(), ""); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	user, _ := store.GetUser(context.Background(), "poli_minister")
+	if user == nil || user.DisplayName != "Poli User" || user.Description != "MP" || !user.Verified {
+		t.Errorf("user = %+v; expected the full profile", user)
+	}
+	changes, _ := store.GetProfileHistory(context.Background(), fakeUserId)
+	if len(changes) != 1 || changes[0].Field != "username" {
+		t.Errorf("changes = %+v; expected only the change of username", changes)
+	}
+}
+
+func TestGetUserTweetsIgnoresCase(t *testing.T) {
+	_, fetcher, store := newFakeTwitter(t, 5)
+	if err := fetcher.AddUser(context.Background(), fakeUserName); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if err := fetcher.GetUserTweets(context.Background(), strings.ToUpper(fakeUserName)); err != nil {
+		t.Fatalf("Error = %v; expected nil", err)
+	}
+	if len(store.tweets) != 5 {
+		t.Errorf("stored tweets = %d; expected = 5", len(store.tweets))
+	}
+}
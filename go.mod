@@ -1,8 +1,10 @@
 module mrnakumar.com/poli
 
-go 1.16
+go 1.18
 
 require (
-	github.com/lib/pq v1.10.4 // indirect
+	github.com/lib/pq v1.10.4
+	github.com/mattn/go-sqlite3 v1.14.9
 	github.com/rs/zerolog v1.22.0
+	gopkg.in/yaml.v2 v2.4.0
 )